@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/cheshir/logrustash"
@@ -13,7 +16,10 @@ import (
 
 	"github.com/sjtug/lug/pkg/config"
 	"github.com/sjtug/lug/pkg/exporter"
+	"github.com/sjtug/lug/pkg/helper"
+	"github.com/sjtug/lug/pkg/logging"
 	"github.com/sjtug/lug/pkg/manager"
+	"github.com/sjtug/lug/pkg/tracing"
 )
 
 const (
@@ -46,8 +52,10 @@ func getFlags() (flags CommandFlags) {
 }
 
 // Register Logger and set logLevel
-func prepareLogger(logLevel log.Level, logStashAddr string, additionalFields map[string]interface{}) {
-	log.SetLevel(logLevel)
+func prepareLogger(logConfig config.LogConfig, logLevel log.Level, logStashAddr string, additionalFields map[string]interface{}, lokiConfig config.LokiConfig) {
+	if err := logging.Setup(logConfig, logLevel); err != nil {
+		log.Fatal(err)
+	}
 	if logStashAddr != "" {
 		hook, err := logrustash.NewAsyncHookWithFields("tcp", logStashAddr, "lug", additionalFields)
 		if err != nil {
@@ -57,7 +65,10 @@ func prepareLogger(logLevel log.Level, logStashAddr string, additionalFields map
 		hook.ReconnectBaseDelay = time.Second
 		hook.ReconnectDelayMultiplier = 2
 		hook.MaxSendRetries = 10
-		log.AddHook(hook)
+		logging.AddHook(hook)
+	}
+	if lokiConfig.URL != "" {
+		logging.EnableLoki(lokiConfig)
 	}
 }
 
@@ -69,6 +80,7 @@ func init() {
 	cfgViper := config.CfgViper
 	cfgViper.BindPFlag("json_api.address", flag.Lookup("jsonapi"))
 	cfgViper.BindPFlag("exporter_address", flag.Lookup("exporter"))
+	cfgViper.BindPFlag("exporter.address", flag.Lookup("exporter"))
 
 	if flags.version {
 		fmt.Print(lugVersionInfo)
@@ -90,7 +102,7 @@ func init() {
 	cfg = config.Config{}
 	err = cfg.Parse(file)
 
-	prepareLogger(cfg.LogLevel, cfg.LogStashConfig.Address, cfg.LogStashConfig.AdditionalFields)
+	prepareLogger(cfg.LogConfig, cfg.LogLevel, cfg.LogStashConfig.Address, cfg.LogStashConfig.AdditionalFields, cfg.LokiConfig)
 	log.Info("Starting...")
 	log.Debugln(spew.Sdump(cfg))
 	if err != nil {
@@ -98,15 +110,63 @@ func init() {
 	}
 }
 
+// reloadCertsOnSIGHUP reloads TLS certificates of listeners when SIGHUP is received
+func reloadCertsOnSIGHUP(reloaders []*helper.CertReloader) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		for _, reloader := range reloaders {
+			if err := reloader.Reload(); err != nil {
+				log.WithField("event", "reload_cert_failed").Error(err)
+			}
+		}
+		log.WithField("event", "reload_cert").Info("TLS certificates reloaded")
+	}
+}
+
 func main() {
+	// exit gracefully on SIGINT and SIGTERM, so that deferred calls below push final metrics,
+	// export remaining spans and ship remaining logs in order
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// deferred first to ship logs of everything else on exit
+	defer logging.FlushLoki()
 	m, err := manager.NewManager(&cfg)
 	if err != nil {
 		panic(err)
 	}
+	if cfg.TracingConfig.Endpoint != "" {
+		shutdown, err := tracing.Setup(cfg.TracingConfig)
+		if err != nil {
+			panic(err)
+		}
+		defer shutdown(context.Background())
+	}
+	if cfg.ExporterConfig.PushGateway.URL != "" {
+		exporter.GetInstance().EnablePushGateway(cfg.ExporterConfig.PushGateway)
+		defer exporter.GetInstance().DisablePushGateway()
+	}
+	if cfg.ExporterConfig.StatsD.Address != "" {
+		if err := exporter.GetInstance().EnableStatsD(cfg.ExporterConfig.StatsD); err != nil {
+			panic(err)
+		}
+	}
+	var reloaders []*helper.CertReloader
 	jsonapi := manager.NewRestfulAPI(m)
-	handler := jsonapi.GetAPIHandler()
-	go http.ListenAndServe(cfg.JsonAPIConfig.Address, handler)
-
-	go exporter.Expose(cfg.ExporterAddr)
-	m.Run()
+	mux := http.NewServeMux()
+	mux.Handle("/", jsonapi.GetAPIHandler())
+	if cfg.SharedListener() {
+		mux.Handle("/metrics", exporter.Handler())
+	} else {
+		exporterMux := http.NewServeMux()
+		exporterMux.Handle("/metrics", exporter.Handler())
+		if reloader := m.Serve("exporter", cfg.ExporterConfig.ListenerConfig, exporterMux); reloader != nil {
+			reloaders = append(reloaders, reloader)
+		}
+	}
+	if reloader := m.Serve("json_api", cfg.JsonAPIConfig.ListenerConfig, mux); reloader != nil {
+		reloaders = append(reloaders, reloader)
+	}
+	go reloadCertsOnSIGHUP(reloaders)
+	m.RunContext(ctx)
 }
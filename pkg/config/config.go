@@ -8,6 +8,8 @@ import (
 	"io"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/davecgh/go-spew/spew"
 	log "github.com/sirupsen/logrus"
@@ -17,9 +19,93 @@ import (
 // RepoConfig stores config of each repo in a map
 type RepoConfig map[string]interface{}
 
+// ListenerConfig describes how a HTTP server of lug listens
+type ListenerConfig struct {
+	// Address is either a TCP address like :7001, or a Unix domain socket like unix:/run/lug.sock
+	Address string
+	// CertFile and KeyFile enable TLS when both are set. They are reloaded on SIGHUP
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// SocketMode is the octal permission of Unix domain socket, e.g. "0660"
+	SocketMode string `mapstructure:"socket_mode"`
+}
+
 type JsonAPIConfig struct {
-	// The address that lug listens for JSON API
+	// The listener that lug serves JSON API on
+	ListenerConfig `mapstructure:",squash"`
+	// Tunasync enables tunasync-compatible job status at /jobs
+	Tunasync bool
+}
+
+type ExporterConfig struct {
+	// The listener that lug exposes metrics on. Address falls back to exporter_address.
+	// If it equals to address of JSON API, metrics are served by the JSON API listener
+	// and other listener options here are ignored
+	ListenerConfig `mapstructure:",squash"`
+	// PushGateway pushes metrics to a Prometheus Pushgateway, for instances which cannot be scraped
+	PushGateway PushGatewayConfig `mapstructure:"pushgateway"`
+	// StatsD emits sync events to a StatsD server
+	StatsD StatsDConfig `mapstructure:"statsd"`
+}
+
+type PushGatewayConfig struct {
+	// URL of Pushgateway, e.g. http://pushgateway:9091. Disabled if empty
+	URL string
+	// Job is the job label of pushed metrics, lug by default
+	Job string
+	// Interval between pushes in seconds. Metrics are also pushed after each sync. 0 disables periodic pushes
+	Interval int
+}
+
+type StatsDConfig struct {
+	// Address is the UDP address of StatsD server, e.g. 127.0.0.1:8125. Disabled if empty
 	Address string
+	// Prefix of metric names, lug by default
+	Prefix string
+	// DogStatsD tags metrics with worker, instead of putting worker into metric names
+	DogStatsD bool `mapstructure:"dogstatsd"`
+}
+
+type TracingConfig struct {
+	// Endpoint is the URL of OTLP/HTTP traces receiver, e.g. http://localhost:4318/v1/traces.
+	// Tracing is disabled if empty
+	Endpoint string
+	// ServiceName is reported as service.name of spans
+	ServiceName string `mapstructure:"service_name"`
+	// SampleRatio is the fraction of syncs traced, between 0 and 1
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+type LogConfig struct {
+	// Format of logs: text (default), json or logfmt
+	Format string
+	// Output of logs: stderr (default), file or syslog
+	Output string
+	// File specifies the log file when output is file
+	File LogFileConfig
+	// Syslog specifies the syslog server when output is syslog
+	Syslog LogSyslogConfig
+	// Levels overrides loglevel of modules, e.g. {worker: 5}. Modules are manager, worker and exporter
+	Levels map[string]log.Level
+}
+
+type LogFileConfig struct {
+	Path string
+	// MaxSize rotates the file when it grows beyond MaxSize megabytes. 0 disables it
+	MaxSize int `mapstructure:"max_size"`
+	// MaxAge rotates the file when it was opened MaxAge seconds ago. 0 disables it
+	MaxAge int `mapstructure:"max_age"`
+	// MaxBackups is how many rotated files are kept. 0 keeps all of them
+	MaxBackups int `mapstructure:"max_backups"`
+}
+
+type LogSyslogConfig struct {
+	// Network is unix, unixgram or udp. Local syslog server is used if both Network and Address are empty
+	Network string
+	// Address is either path of Unix socket, e.g. /dev/log, or UDP address, e.g. 127.0.0.1:514
+	Address string
+	// Tag of messages, lug by default
+	Tag string
 }
 
 type LogStashConfig struct {
@@ -27,6 +113,49 @@ type LogStashConfig struct {
 	AdditionalFields map[string]interface{} `mapstructure:"additional_fields"`
 }
 
+type LokiConfig struct {
+	// URL of Loki push API, e.g. http://loki:3100/loki/api/v1/push. Disabled if empty
+	URL string
+	// TenantID is sent as X-Scope-OrgID if not empty
+	TenantID string `mapstructure:"tenant_id"`
+	// Labels are attached to all streams, e.g. {host: mirror1}
+	Labels map[string]string
+	// BatchSize is the maximum number of lines in a push
+	BatchSize int `mapstructure:"batch_size"`
+	// BatchWait is the maximum seconds a line waits before it is pushed
+	BatchWait int `mapstructure:"batch_wait"`
+	// MaxRetries of a failed push before the batch is dropped
+	MaxRetries int `mapstructure:"max_retries"`
+}
+
+// MirrorzSiteConfig describes the site section of mirrorz status. Refer to https://mirrorz.org for details
+type MirrorzSiteConfig struct {
+	URL          string `mapstructure:"url" json:"url,omitempty"`
+	Logo         string `mapstructure:"logo" json:"logo,omitempty"`
+	LogoDarkmode string `mapstructure:"logo_darkmode" json:"logo_darkmode,omitempty"`
+	Abbr         string `mapstructure:"abbr" json:"abbr,omitempty"`
+	Name         string `mapstructure:"name" json:"name,omitempty"`
+	Homepage     string `mapstructure:"homepage" json:"homepage,omitempty"`
+	Issue        string `mapstructure:"issue" json:"issue,omitempty"`
+	Request      string `mapstructure:"request" json:"request,omitempty"`
+	Email        string `mapstructure:"email" json:"email,omitempty"`
+	Group        string `mapstructure:"group" json:"group,omitempty"`
+	Disk         string `mapstructure:"disk" json:"disk,omitempty"`
+	Note         string `mapstructure:"note" json:"note,omitempty"`
+	Big          string `mapstructure:"big" json:"big,omitempty"`
+}
+
+type MirrorzConfig struct {
+	Site MirrorzSiteConfig
+}
+
+type StatusPageConfig struct {
+	// Template is the path of html/template to render status page. The built-in one is used if empty
+	Template string
+	// Output is the file where status page is rendered to after each sync. Disabled if empty
+	Output string
+}
+
 // Config stores all configuration of lug
 type Config struct {
 	// Interval between pollings in manager
@@ -35,12 +164,24 @@ type Config struct {
 	LogLevel log.Level
 	// ConcurrentLimit: how many worker can run at the same time
 	ConcurrentLimit int `mapstructure:"concurrent_limit"`
+	// LogConfig specifies format and destination of logs
+	LogConfig LogConfig `mapstructure:"log"`
 	// LogStashConfig represents configurations for logstash
 	LogStashConfig LogStashConfig `mapstructure:"logstash"`
+	// LokiConfig specifies Grafana Loki where logs and outputs of workers are shipped to
+	LokiConfig LokiConfig `mapstructure:"loki"`
 	// ExporterAddr is the address to expose metrics, :8080 for default
 	ExporterAddr string `mapstructure:"exporter_address"`
+	// ExporterConfig specifies configuration of metrics listener
+	ExporterConfig ExporterConfig `mapstructure:"exporter"`
 	// JsonAPIConfig specifies configuration of JSON restful API
 	JsonAPIConfig JsonAPIConfig `mapstructure:"json_api"`
+	// MirrorzConfig specifies site information of mirrorz status
+	MirrorzConfig MirrorzConfig `mapstructure:"mirrorz"`
+	// StatusPageConfig specifies how HTML status page is rendered
+	StatusPageConfig StatusPageConfig `mapstructure:"status_page"`
+	// TracingConfig specifies where OpenTelemetry spans of syncs are exported
+	TracingConfig TracingConfig `mapstructure:"tracing"`
 	// Worker sync checkpoint path
 	Checkpoint string `mapstructure:"checkpoint"`
 	// Config for each repo is represented as an array of RepoConfig. Nested structure is disallowed
@@ -58,6 +199,11 @@ func init() {
 	CfgViper.SetDefault("json_api.address", ":7001")
 	CfgViper.SetDefault("exporter_address", ":8080")
 	CfgViper.SetDefault("concurrent_limit", 5)
+	CfgViper.SetDefault("loki.batch_size", 1000)
+	CfgViper.SetDefault("loki.batch_wait", 1)
+	CfgViper.SetDefault("loki.max_retries", 5)
+	CfgViper.SetDefault("tracing.service_name", "lug")
+	CfgViper.SetDefault("tracing.sample_ratio", 1)
 }
 
 // Parse creates config from a reader
@@ -78,6 +224,32 @@ func (c *Config) Parse(in io.Reader) (err error) {
 		if c.ConcurrentLimit <= 0 {
 			return errors.New("concurrent limit must be positive")
 		}
+		if c.ExporterConfig.Address == "" {
+			c.ExporterConfig.Address = c.ExporterAddr
+		}
+		for _, l := range []ListenerConfig{c.JsonAPIConfig.ListenerConfig, c.ExporterConfig.ListenerConfig} {
+			if err := l.validate(); err != nil {
+				return err
+			}
+		}
+		if err := c.LogConfig.validate(); err != nil {
+			return err
+		}
+		if c.LokiConfig.BatchSize <= 0 || c.LokiConfig.BatchWait <= 0 || c.LokiConfig.MaxRetries < 0 {
+			return errors.New("loki batch_size and batch_wait must be positive, and max_retries can't be negative")
+		}
+		if c.TracingConfig.SampleRatio < 0 || c.TracingConfig.SampleRatio > 1 {
+			return errors.New("tracing sample_ratio must be between 0 and 1")
+		}
+		if c.ExporterConfig.PushGateway.Interval < 0 {
+			return errors.New("pushgateway interval can't be negative")
+		}
+		if c.ExporterConfig.PushGateway.Job == "" {
+			c.ExporterConfig.PushGateway.Job = "lug"
+		}
+		if c.ExporterConfig.StatsD.Prefix == "" {
+			c.ExporterConfig.StatsD.Prefix = "lug"
+		}
 	}
 	for _, repo := range c.Repos {
 		var removeKeys []string
@@ -108,3 +280,80 @@ func (c *Config) Parse(in io.Reader) (err error) {
 	}
 	return err
 }
+
+// SharedListener returns true if metrics are served by the JSON API listener
+func (c *Config) SharedListener() bool {
+	return c.ExporterConfig.Address == c.JsonAPIConfig.Address
+}
+
+// validate checks whether the listener config is consistent
+func (l ListenerConfig) validate() error {
+	if (l.CertFile == "") != (l.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	if l.SocketMode != "" {
+		if !l.IsUnix() {
+			return errors.New("socket_mode is only valid for unix: addresses")
+		}
+		if _, err := l.FileMode(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsUnix returns true if the listener is a Unix domain socket
+func (l ListenerConfig) IsUnix() bool {
+	return strings.HasPrefix(l.Address, "unix:")
+}
+
+// SocketPath returns the path of Unix domain socket
+func (l ListenerConfig) SocketPath() string {
+	return strings.TrimPrefix(l.Address, "unix:")
+}
+
+// FileMode parses SocketMode, returning 0 if it is unset
+func (l ListenerConfig) FileMode() (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket_mode %q: must be octal permission like \"0660\"", l.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// LogModules are modules whose loglevel could be overridden
+var LogModules = []string{"manager", "worker", "exporter"}
+
+// validate checks whether log config is consistent
+func (l LogConfig) validate() error {
+	switch l.Format {
+	case "", "text", "json", "logfmt":
+	default:
+		return errors.New("log format should be text, json or logfmt when present")
+	}
+	switch l.Output {
+	case "", "stderr", "syslog":
+	case "file":
+		if l.File.Path == "" {
+			return errors.New("log file path must be set when output is file")
+		}
+	default:
+		return errors.New("log output should be stderr, file or syslog when present")
+	}
+	for module, level := range l.Levels {
+		found := false
+		for _, m := range LogModules {
+			found = found || m == module
+		}
+		if !found {
+			return fmt.Errorf("unknown module %s in log levels", module)
+		}
+		if level > 5 {
+			return fmt.Errorf("log level of %s must be 0-5", module)
+		}
+	}
+	return nil
+}
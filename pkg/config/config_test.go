@@ -127,3 +127,93 @@ repos:
 
 	asrt.Equal("concurrent limit must be positive", err.Error())
 }
+
+func TestParseListenerConfig(t *testing.T) {
+	const testStr = `interval: 25
+loglevel: 5
+exporter_address: :9090
+json_api:
+  address: unix:/run/lug/api.sock
+  socket_mode: "0660"
+repos: []
+`
+	c := Config{}
+	err := c.Parse(strings.NewReader(testStr))
+	asrt := assert.New(t)
+	asrt.NoError(err)
+	asrt.True(c.JsonAPIConfig.IsUnix())
+	asrt.Equal("/run/lug/api.sock", c.JsonAPIConfig.SocketPath())
+	mode, err := c.JsonAPIConfig.FileMode()
+	asrt.NoError(err)
+	asrt.EqualValues(0660, mode)
+	// exporter falls back to exporter_address
+	asrt.Equal(":9090", c.ExporterConfig.Address)
+	asrt.False(c.ExporterConfig.IsUnix())
+	asrt.False(c.SharedListener())
+
+	const wrongStr = `interval: 25
+loglevel: 5
+json_api:
+  address: :7001
+  cert_file: /etc/lug/cert.pem
+repos: []
+`
+	c = Config{}
+	err = c.Parse(strings.NewReader(wrongStr))
+	asrt.EqualError(err, "cert_file and key_file must be set together")
+}
+
+func TestParseExporterPushConfig(t *testing.T) {
+	const testStr = `interval: 25
+loglevel: 5
+exporter:
+  pushgateway:
+    url: http://127.0.0.1:9091
+    interval: 60
+  statsd:
+    address: 127.0.0.1:8125
+    dogstatsd: true
+repos: []
+`
+	c := Config{}
+	err := c.Parse(strings.NewReader(testStr))
+	asrt := assert.New(t)
+	asrt.NoError(err)
+	asrt.Equal(PushGatewayConfig{URL: "http://127.0.0.1:9091", Job: "lug", Interval: 60}, c.ExporterConfig.PushGateway)
+	asrt.Equal(StatsDConfig{Address: "127.0.0.1:8125", Prefix: "lug", DogStatsD: true}, c.ExporterConfig.StatsD)
+}
+
+func TestParseLogConfig(t *testing.T) {
+	const testStr = `interval: 25
+loglevel: 4
+log:
+  format: json
+  output: file
+  file:
+    path: /var/log/lug.log
+    max_size: 100
+  levels:
+    worker: 5
+repos: []
+`
+	c := Config{}
+	err := c.Parse(strings.NewReader(testStr))
+	asrt := assert.New(t)
+	asrt.NoError(err)
+	asrt.Equal("json", c.LogConfig.Format)
+	asrt.Equal(LogFileConfig{Path: "/var/log/lug.log", MaxSize: 100}, c.LogConfig.File)
+	asrt.EqualValues(5, c.LogConfig.Levels["worker"])
+	// loki is disabled, but has defaults
+	asrt.Equal(LokiConfig{BatchSize: 1000, BatchWait: 1, MaxRetries: 5}, c.LokiConfig)
+
+	const wrongStr = `interval: 25
+loglevel: 4
+log:
+  levels:
+    scheduler: 5
+repos: []
+`
+	c = Config{}
+	err = c.Parse(strings.NewReader(wrongStr))
+	asrt.EqualError(err, "unknown module scheduler in log levels")
+}
@@ -11,20 +11,55 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/sjtug/lug/pkg/helper"
+	"github.com/sjtug/lug/pkg/logging"
 )
 
 // Exporter exports lug metrics to Prometheus. All operations are thread-safe
 type Exporter struct {
-	successCounter *prometheus.CounterVec
-	failCounter    *prometheus.CounterVec
-	diskUsage      *prometheus.GaugeVec
+	// Deprecated: successCounter and failCounter are kept for existing dashboards,
+	// use syncSuccessCounter and syncFailCounter in lug namespace instead
+	successCounter     *prometheus.CounterVec
+	failCounter        *prometheus.CounterVec
+	syncSuccessCounter *prometheus.CounterVec
+	syncFailCounter    *prometheus.CounterVec
+	syncRetryCounter   *prometheus.CounterVec
+	syncDuration       *prometheus.HistogramVec
+	syncRunning        *prometheus.GaugeVec
+	lastSuccess        *prometheus.GaugeVec
+	lastAttempt        *prometheus.GaugeVec
+	workerInterval     *prometheus.GaugeVec
+	pendingQueueLength prometheus.Gauge
+	managerRunning     prometheus.Gauge
+	diskUsage          *prometheus.GaugeVec
+	diskFiles          *prometheus.GaugeVec
+	diskDirs           *prometheus.GaugeVec
+	transferFiles      *prometheus.GaugeVec
+	transferBytes      *prometheus.GaugeVec
+	transferBytesTotal *prometheus.CounterVec
+	transferTotalSize  *prometheus.GaugeVec
+	transferSpeedup    *prometheus.GaugeVec
 	// stores worker_name -> last time that updates its disk usage
 	diskUsageLastUpdateTime map[string]time.Time
+	// stores worker_name -> last disk usage in bytes
+	diskUsageBytes map[string]int64
+	// stores worker_name -> whether a scan is running
+	diskUsageScanning map[string]bool
+	// stores worker_name -> whether another scan is requested when a scan is running
+	diskUsageRescan map[string]bool
+	// stores worker_name -> metrics reported by its script in last run
+	scriptMetrics map[string][]ScriptMetric
+	// push targets of sync events, nil if disabled
+	pushGateway *pushGateway
+	statsd      *statsdClient
 	// guard the exporter
 	mutex sync.Mutex
 }
 
+// moduleLogger is the logger of exporter module
+var moduleLogger = logging.Logger("exporter")
+
 var instance *Exporter
+var instanceOnce sync.Once
 
 // newExporter creates a new exporter
 func newExporter() *Exporter {
@@ -43,6 +78,96 @@ func newExporter() *Exporter {
 			},
 			[]string{"worker"},
 		),
+		syncSuccessCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "lug",
+				Subsystem: "sync",
+				Name:      "success_total",
+				Help:      "How many successful synchronizations processed, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		syncFailCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "lug",
+				Subsystem: "sync",
+				Name:      "fail_total",
+				Help:      "How many failed synchronizations processed, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		syncRetryCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "lug",
+				Subsystem: "sync",
+				Name:      "retries_total",
+				Help:      "How many failed attempts are retried, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		syncDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "lug",
+				Subsystem: "sync",
+				Name:      "duration_seconds",
+				Help:      "Duration of synchronizations including retries, partitioned by workers and results.",
+				// 1s to about 3 days
+				Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+			},
+			[]string{"worker", "result"},
+		),
+		syncRunning: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "sync",
+				Name:      "running",
+				Help:      "Whether the worker is synchronizing, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		lastSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "sync",
+				Name:      "last_success_timestamp_seconds",
+				Help:      "Unix timestamp of last successful synchronization, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		lastAttempt: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "sync",
+				Name:      "last_attempt_timestamp_seconds",
+				Help:      "Unix timestamp when last synchronization started, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		workerInterval: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "worker",
+				Name:      "interval_seconds",
+				Help:      "Configured interval between synchronizations, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		pendingQueueLength: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "manager",
+				Name:      "pending_queue_length",
+				Help:      "How many workers are waiting for a free slot to synchronize.",
+			},
+		),
+		managerRunning: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "manager",
+				Name:      "running",
+				Help:      "Whether the manager is polling workers.",
+			},
+		),
 		diskUsage: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Namespace: "lug",
@@ -52,80 +177,289 @@ func newExporter() *Exporter {
 			},
 			[]string{"worker"},
 		),
+		diskFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "storage",
+				Name:      "files",
+				Help:      "Number of files, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		diskDirs: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "storage",
+				Name:      "dirs",
+				Help:      "Number of directories, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		transferFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "transfer",
+				Name:      "files_transferred",
+				Help:      "Number of files transferred in last synchronization, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		transferBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "transfer",
+				Name:      "bytes_received",
+				Help:      "Bytes received in last synchronization, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		transferBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "lug",
+				Subsystem: "transfer",
+				Name:      "bytes_received_total",
+				Help:      "Bytes received in all synchronizations, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		transferTotalSize: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "transfer",
+				Name:      "total_size_bytes",
+				Help:      "Total size of files in upstream reported by last synchronization, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
+		transferSpeedup: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "lug",
+				Subsystem: "transfer",
+				Name:      "speedup",
+				Help:      "Speedup reported by last synchronization, partitioned by workers.",
+			},
+			[]string{"worker"},
+		),
 		diskUsageLastUpdateTime: map[string]time.Time{},
+		diskUsageBytes:          map[string]int64{},
+		diskUsageScanning:       map[string]bool{},
+		diskUsageRescan:         map[string]bool{},
+		scriptMetrics:           map[string][]ScriptMetric{},
 	}
 	prometheus.MustRegister(newExporter.successCounter)
 	prometheus.MustRegister(newExporter.failCounter)
+	prometheus.MustRegister(newExporter.syncSuccessCounter)
+	prometheus.MustRegister(newExporter.syncFailCounter)
+	prometheus.MustRegister(newExporter.syncRetryCounter)
+	prometheus.MustRegister(newExporter.syncDuration)
+	prometheus.MustRegister(newExporter.syncRunning)
+	prometheus.MustRegister(newExporter.lastSuccess)
+	prometheus.MustRegister(newExporter.lastAttempt)
+	prometheus.MustRegister(newExporter.workerInterval)
+	prometheus.MustRegister(newExporter.pendingQueueLength)
+	prometheus.MustRegister(newExporter.managerRunning)
 	prometheus.MustRegister(newExporter.diskUsage)
-	log.Info("Exporter initialized")
+	prometheus.MustRegister(newExporter.diskFiles)
+	prometheus.MustRegister(newExporter.diskDirs)
+	prometheus.MustRegister(newExporter.transferFiles)
+	prometheus.MustRegister(newExporter.transferBytes)
+	prometheus.MustRegister(newExporter.transferBytesTotal)
+	prometheus.MustRegister(newExporter.transferTotalSize)
+	prometheus.MustRegister(newExporter.transferSpeedup)
+	prometheus.MustRegister(scriptMetricsCollector{e: &newExporter})
+	moduleLogger.Info("Exporter initialized")
 	return &newExporter
 }
 
 // GetInstance gets the exporter
 func GetInstance() *Exporter {
-	if instance == nil {
+	instanceOnce.Do(func() {
 		instance = newExporter()
-	}
+	})
 	return instance
 }
 
-// Expose the registered metrics via HTTP.
-func Expose(addr string) {
+// Handler returns a handler exposing the registered metrics via HTTP.
+func Handler() http.Handler {
 	GetInstance() // ensure init
-	http.Handle("/metrics", promhttp.Handler())
-	log.Info("Metrics exposed at " + addr + "/metrics")
-	log.Fatal(http.ListenAndServe(addr, nil))
+	return promhttp.Handler()
+}
+
+// SyncStart will report the start of a synchronization
+func (e *Exporter) SyncStart(worker string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	labels := prometheus.Labels{"worker": worker}
+	e.syncRunning.With(labels).Set(1)
+	e.lastAttempt.With(labels).Set(float64(time.Now().Unix()))
+	e.syncRetryCounter.With(labels).Add(0)
+}
+
+// SyncRetry will report a failed attempt which is going to be retried
+func (e *Exporter) SyncRetry(worker string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.syncRetryCounter.With(prometheus.Labels{"worker": worker}).Inc()
 }
 
-// SyncSuccess will report a successful synchronization
-func (e *Exporter) SyncSuccess(worker string) {
+// SyncSuccess will report a successful synchronization, which takes duration to finish
+func (e *Exporter) SyncSuccess(worker string, duration time.Duration) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
-	e.successCounter.With(prometheus.Labels{"worker": worker}).Inc()
-	e.failCounter.With(prometheus.Labels{"worker": worker}).Add(0)
+	labels := prometheus.Labels{"worker": worker}
+	e.successCounter.With(labels).Inc()
+	e.failCounter.With(labels).Add(0)
+	e.syncSuccessCounter.With(labels).Inc()
+	e.syncFailCounter.With(labels).Add(0)
+	e.syncDuration.With(prometheus.Labels{"worker": worker, "result": "success"}).Observe(duration.Seconds())
+	e.syncRunning.With(labels).Set(0)
+	e.lastSuccess.With(labels).Set(float64(time.Now().Unix()))
+	e.pushSyncFinished(worker, "success", duration)
 }
 
-// SyncFail will report a failed synchronization
-func (e *Exporter) SyncFail(worker string) {
+// SyncFail will report a failed synchronization, which takes duration to finish
+func (e *Exporter) SyncFail(worker string, duration time.Duration) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
-	e.failCounter.With(prometheus.Labels{"worker": worker}).Inc()
-	e.successCounter.With(prometheus.Labels{"worker": worker}).Add(0)
+	labels := prometheus.Labels{"worker": worker}
+	e.failCounter.With(labels).Inc()
+	e.successCounter.With(labels).Add(0)
+	e.syncFailCounter.With(labels).Inc()
+	e.syncSuccessCounter.With(labels).Add(0)
+	e.syncDuration.With(prometheus.Labels{"worker": worker, "result": "fail"}).Observe(duration.Seconds())
+	e.syncRunning.With(labels).Set(0)
+	e.pushSyncFinished(worker, "fail", duration)
+}
+
+// SetLastSuccess sets the time of last successful synchronization, e.g. restored from checkpoint
+func (e *Exporter) SetLastSuccess(worker string, t time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastSuccess.With(prometheus.Labels{"worker": worker}).Set(float64(t.Unix()))
+}
+
+// SetWorkerInterval sets the configured interval of worker
+func (e *Exporter) SetWorkerInterval(worker string, interval time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.workerInterval.With(prometheus.Labels{"worker": worker}).Set(interval.Seconds())
+}
+
+// SetPendingQueueLength sets the length of pending queue of manager
+func (e *Exporter) SetPendingQueueLength(length int) {
+	e.pendingQueueLength.Set(float64(length))
+}
+
+// SetManagerRunning sets whether the manager is polling workers
+func (e *Exporter) SetManagerRunning(running bool) {
+	if running {
+		e.managerRunning.Set(1)
+	} else {
+		e.managerRunning.Set(0)
+	}
 }
 
 // need at least 1min to rescan disk
 const updateDiskUsageThrottle time.Duration = time.Minute
 
-// UpdateDiskUsage will update the disk usage of a directory.
+// UpdateDiskUsage will update the disk usage of a directory, e.g. after a successful sync.
 // This call is asynchronous at rate-limited per worker
 func (e *Exporter) UpdateDiskUsage(worker string, path string) {
+	e.updateDiskUsage(worker, path, updateDiskUsageThrottle, true)
+}
+
+// RefreshDiskUsage will update the disk usage of a directory if it has not been updated
+// within maxAge. This call is asynchronous and is meant to be called periodically
+func (e *Exporter) RefreshDiskUsage(worker string, path string, maxAge time.Duration) {
+	e.updateDiskUsage(worker, path, maxAge, false)
+}
+
+// GetDiskUsage returns the disk usage of worker in bytes, and whether it has been scanned
+func (e *Exporter) GetDiskUsage(worker string) (int64, bool) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
-	lastUpdateTime, found := e.diskUsageLastUpdateTime[worker]
-	logger := log.WithFields(log.Fields{
+	size, found := e.diskUsageBytes[worker]
+	return size, found
+}
+
+// updateDiskUsage launches a background scan if the last one finished before throttle.
+// A scan could take longer than throttle on large mirrors. If rescan is true and a scan
+// is still running, another scan is queued after it, since the running one may not see
+// the latest content.
+func (e *Exporter) updateDiskUsage(worker string, path string, throttle time.Duration, rescan bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	logger := moduleLogger.WithFields(log.Fields{
 		"worker": worker,
 		"path":   path,
 	})
-	logger.WithField("event", "update_disk_usage").Info("Invoke UpdateDiskUsage")
-	if !found || time.Now().Sub(lastUpdateTime) > updateDiskUsageThrottle {
-		logger.Debug("background update_disk_usage launched")
-		// first, we set it to infinity (2037-01-01)
-		// Note that we cannot use a larger value due to Y2038 problem on *nix
-		e.diskUsageLastUpdateTime[worker] = time.Date(
-			2037, 1, 1, 0, 0, 0, 0, time.Local)
-		// then, we perform the operation in background
-		go func() {
-			size, err := helper.DiskUsage(path)
-			// the above step is time-consuming, so acquire the lock after it completes
-			e.mutex.Lock()
-			defer e.mutex.Unlock()
-			if err == nil {
-				e.diskUsage.With(prometheus.Labels{"worker": worker}).Set(float64(size))
-			}
-			// when it finishes, we set it to actual finishing time
-			e.diskUsageLastUpdateTime[worker] = time.Now()
-			logger.WithField(
-				"event", "update_disk_usage_complete").WithField("size", size).Info("Disk usage updated")
-		}()
+	logger.WithField("event", "update_disk_usage").Debug("Invoke UpdateDiskUsage")
+	if e.diskUsageScanning[worker] {
+		if rescan {
+			logger.Debug("update_disk_usage is running, queue a rescan")
+			e.diskUsageRescan[worker] = true
+		}
+		return
+	}
+	lastUpdateTime, found := e.diskUsageLastUpdateTime[worker]
+	if found && time.Since(lastUpdateTime) <= throttle {
+		return
 	}
+	e.scanDiskUsage(worker, path, logger)
+}
+
+// scanDiskUsage performs the scan in background. Call it with mutex held
+func (e *Exporter) scanDiskUsage(worker string, path string, logger *log.Entry) {
+	logger.Debug("background update_disk_usage launched")
+	e.diskUsageScanning[worker] = true
+	go func() {
+		usage, err := helper.DiskUsage(path)
+		// the above step is time-consuming, so acquire the lock after it completes
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		if err == nil {
+			labels := prometheus.Labels{"worker": worker}
+			e.diskUsage.With(labels).Set(float64(usage.Bytes))
+			e.diskFiles.With(labels).Set(float64(usage.Files))
+			e.diskDirs.With(labels).Set(float64(usage.Dirs))
+			e.diskUsageBytes[worker] = usage.Bytes
+			logger.WithFields(log.Fields{
+				"event":   "update_disk_usage_complete",
+				"size":    usage.Bytes,
+				"files":   usage.Files,
+				"dirs":    usage.Dirs,
+				"skipped": usage.Skipped,
+			}).Info("Disk usage updated")
+		} else {
+			logger.WithField("event", "update_disk_usage_failed").Warn(err)
+		}
+		// when it finishes, we set it to actual finishing time
+		e.diskUsageLastUpdateTime[worker] = time.Now()
+		e.diskUsageScanning[worker] = false
+		if e.diskUsageRescan[worker] {
+			e.diskUsageRescan[worker] = false
+			e.scanDiskUsage(worker, path, logger)
+		}
+	}()
+}
+
+// TransferStats is the transfer accounting of a synchronization, e.g. parsed from rsync --stats
+type TransferStats struct {
+	FilesTransferred int64
+	BytesReceived    int64
+	// TotalSize is the size of all files in source
+	TotalSize int64
+	Speedup   float64
+}
+
+// SetTransferStats reports the transfer accounting of last synchronization
+func (e *Exporter) SetTransferStats(worker string, stats TransferStats) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	labels := prometheus.Labels{"worker": worker}
+	e.transferFiles.With(labels).Set(float64(stats.FilesTransferred))
+	e.transferBytes.With(labels).Set(float64(stats.BytesReceived))
+	e.transferBytesTotal.With(labels).Add(float64(stats.BytesReceived))
+	e.transferTotalSize.With(labels).Set(float64(stats.TotalSize))
+	e.transferSpeedup.With(labels).Set(stats.Speedup)
 }
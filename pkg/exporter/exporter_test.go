@@ -0,0 +1,277 @@
+package exporter
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/helper"
+)
+
+func TestSyncLifecycleMetrics(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	labels := prometheus.Labels{"worker": "lifecycle"}
+
+	before := time.Now().Unix()
+	e.SyncStart("lifecycle")
+	asrt.Equal(1.0, testutil.ToFloat64(e.syncRunning.With(labels)))
+	asrt.GreaterOrEqual(testutil.ToFloat64(e.lastAttempt.With(labels)), float64(before))
+	e.SyncRetry("lifecycle")
+	e.SyncRetry("lifecycle")
+	e.SyncFail("lifecycle", 3*time.Second)
+	asrt.Equal(0.0, testutil.ToFloat64(e.syncRunning.With(labels)))
+	asrt.Equal(2.0, testutil.ToFloat64(e.syncRetryCounter.With(labels)))
+	asrt.Equal(1.0, testutil.ToFloat64(e.syncFailCounter.With(labels)))
+	asrt.Equal(0.0, testutil.ToFloat64(e.syncSuccessCounter.With(labels)))
+	asrt.Equal(1.0, testutil.ToFloat64(e.failCounter.With(labels)))
+
+	e.SyncStart("lifecycle")
+	e.SyncSuccess("lifecycle", 5*time.Second)
+	asrt.Equal(1.0, testutil.ToFloat64(e.syncSuccessCounter.With(labels)))
+	asrt.GreaterOrEqual(testutil.ToFloat64(e.lastSuccess.With(labels)), float64(before))
+	asrt.Equal(2, testutil.CollectAndCount(e.syncDuration, "lug_sync_duration_seconds"))
+
+	e.SetLastSuccess("lifecycle", time.Unix(1000, 0))
+	asrt.Equal(1000.0, testutil.ToFloat64(e.lastSuccess.With(labels)))
+	e.SetWorkerInterval("lifecycle", time.Hour)
+	asrt.Equal(3600.0, testutil.ToFloat64(e.workerInterval.With(labels)))
+}
+
+func TestManagerMetrics(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	e.SetPendingQueueLength(3)
+	asrt.Equal(3.0, testutil.ToFloat64(e.pendingQueueLength))
+	e.SetManagerRunning(true)
+	asrt.Equal(1.0, testutil.ToFloat64(e.managerRunning))
+	e.SetManagerRunning(false)
+	asrt.Equal(0.0, testutil.ToFloat64(e.managerRunning))
+}
+
+// waitDiskUsageScan waits until no scan of worker is running
+func waitDiskUsageScan(e *Exporter, worker string) {
+	for {
+		e.mutex.Lock()
+		scanning := e.diskUsageScanning[worker]
+		e.mutex.Unlock()
+		if !scanning {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpdateDiskUsage(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	dir := t.TempDir()
+	asrt.NoError(os.WriteFile(filepath.Join(dir, "a"), []byte("lug"), 0644))
+	expected, err := helper.DiskUsage(dir)
+	asrt.NoError(err)
+
+	_, found := e.GetDiskUsage("disk")
+	asrt.False(found)
+	e.UpdateDiskUsage("disk", dir)
+	waitDiskUsageScan(e, "disk")
+	size, found := e.GetDiskUsage("disk")
+	asrt.True(found)
+	asrt.Equal(expected.Bytes, size)
+	labels := prometheus.Labels{"worker": "disk"}
+	asrt.EqualValues(expected.Bytes, testutil.ToFloat64(e.diskUsage.With(labels)))
+	asrt.EqualValues(1, testutil.ToFloat64(e.diskFiles.With(labels)))
+	asrt.EqualValues(1, testutil.ToFloat64(e.diskDirs.With(labels)))
+
+	// throttled
+	asrt.NoError(os.WriteFile(filepath.Join(dir, "b"), []byte("lug"), 0644))
+	e.UpdateDiskUsage("disk", dir)
+	waitDiskUsageScan(e, "disk")
+	asrt.EqualValues(1, testutil.ToFloat64(e.diskFiles.With(labels)))
+
+	e.RefreshDiskUsage("disk", dir, 0)
+	waitDiskUsageScan(e, "disk")
+	asrt.EqualValues(2, testutil.ToFloat64(e.diskFiles.With(labels)))
+}
+
+func TestUpdateDiskUsageRescan(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	dir := t.TempDir()
+	// pretend a scan is running, a sync finishing meanwhile should queue another scan
+	e.mutex.Lock()
+	e.diskUsageScanning["rescan"] = true
+	e.mutex.Unlock()
+	e.RefreshDiskUsage("rescan", dir, 0)
+	e.mutex.Lock()
+	asrt.False(e.diskUsageRescan["rescan"])
+	e.mutex.Unlock()
+	e.UpdateDiskUsage("rescan", dir)
+	e.mutex.Lock()
+	asrt.True(e.diskUsageRescan["rescan"])
+	e.mutex.Unlock()
+}
+
+func TestParseScriptMetrics(t *testing.T) {
+	asrt := assert.New(t)
+	metrics, err := ParseScriptMetrics(strings.NewReader(`
+# reported by rsync wrapper
+bytes_transferred=1024
+files_added = 3
+upstream_timestamp=1.6e9
+`))
+	asrt.NoError(err)
+	asrt.Equal([]ScriptMetric{
+		{Name: "bytes_transferred", Value: 1024},
+		{Name: "files_added", Value: 3},
+		{Name: "upstream_timestamp", Value: 1.6e9},
+	}, metrics)
+
+	metrics, err = ParseScriptMetrics(strings.NewReader(`# TYPE files_deleted gauge
+files_deleted{dir="pool"} 2
+files_deleted{dir="dists"} 1
+bytes_total 42
+`))
+	asrt.NoError(err)
+	asrt.Equal([]ScriptMetric{
+		{Name: "bytes_total", Labels: map[string]string{}, Value: 42},
+		{Name: "files_deleted", Labels: map[string]string{"dir": "dists"}, Value: 1},
+		{Name: "files_deleted", Labels: map[string]string{"dir": "pool"}, Value: 2},
+	}, metrics)
+	asrt.Equal(`files_deleted{dir="dists"} 1`, metrics[1].String())
+
+	_, err = ParseScriptMetrics(strings.NewReader("bytes=many\n"))
+	asrt.Error(err)
+	_, err = ParseScriptMetrics(strings.NewReader("bad-name=1\n"))
+	asrt.Error(err)
+	_, err = ParseScriptMetrics(strings.NewReader(`files{worker="other"} 1` + "\n"))
+	asrt.Error(err)
+	_, err = ParseScriptMetrics(strings.NewReader("# TYPE duration histogram\nduration_bucket{le=\"1\"} 1\nduration_count 1\nduration_sum 1\n"))
+	asrt.Error(err)
+}
+
+func TestScriptMetricsCollector(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	e.SetScriptMetrics("script_a", []ScriptMetric{
+		{Name: "files_added", Labels: map[string]string{"dir": "pool"}, Value: 3},
+	})
+	e.SetScriptMetrics("script_b", []ScriptMetric{
+		{Name: "files_added", Labels: map[string]string{"dir": "pool"}, Value: 5},
+		// inconsistent with script_a, dropped
+		{Name: "files_added", Value: 1},
+	})
+	defer e.SetScriptMetrics("script_a", nil)
+	defer e.SetScriptMetrics("script_b", nil)
+	expected := `# HELP lug_script_files_added Metric reported by sync script, partitioned by workers.
+# TYPE lug_script_files_added gauge
+lug_script_files_added{dir="pool",worker="script_a"} 3
+lug_script_files_added{dir="pool",worker="script_b"} 5
+`
+	asrt.NoError(testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(expected), "lug_script_files_added"))
+}
+
+func TestPushGateway(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	pushed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == http.MethodPut {
+			pushed <- r.URL.Path + "\n" + string(body)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	e.EnablePushGateway(config.PushGatewayConfig{URL: server.URL, Job: "lug"})
+
+	e.SyncSuccess("pushed", time.Second)
+	select {
+	case body := <-pushed:
+		asrt.True(strings.HasPrefix(body, "/metrics/job/lug\n"))
+		asrt.Contains(body, "lug_sync_success_total")
+		asrt.Contains(body, "pushed")
+	case <-time.After(5 * time.Second):
+		asrt.Fail("metrics not pushed")
+	}
+
+	// metrics are pushed for the last time when disabled on exit
+	e.DisablePushGateway()
+	select {
+	case <-pushed:
+	default:
+		asrt.Fail("metrics not pushed on exit")
+	}
+}
+
+func TestPushGatewayInFlight(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	pushed := make(chan struct{}, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	e.EnablePushGateway(config.PushGatewayConfig{URL: server.URL, Job: "lug"})
+	defer e.DisablePushGateway()
+	wait := func() {
+		select {
+		case <-pushed:
+		case <-time.After(5 * time.Second):
+			asrt.Fail("metrics not pushed")
+		}
+	}
+
+	// syncs finished during a hanging push are merged into a single push after it
+	e.SyncSuccess("in_flight", time.Second)
+	wait()
+	for i := 0; i < 5; i++ {
+		e.SyncSuccess("in_flight", time.Second)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wait()
+	time.Sleep(100 * time.Millisecond)
+	asrt.Empty(pushed)
+}
+
+func TestStatsD(t *testing.T) {
+	asrt := assert.New(t)
+	e := GetInstance()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	asrt.NoError(err)
+	defer conn.Close()
+	defer func() {
+		e.mutex.Lock()
+		e.statsd = nil
+		e.mutex.Unlock()
+	}()
+	receive := func() string {
+		buf := make([]byte, 1024)
+		asrt.NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		asrt.NoError(err)
+		return string(buf[:n])
+	}
+
+	asrt.NoError(e.EnableStatsD(config.StatsDConfig{Address: conn.LocalAddr().String(), Prefix: "lug"}))
+	e.SyncSuccess("deb.ian", 1500*time.Millisecond)
+	asrt.Equal("lug.sync.success.deb_ian:1|c\nlug.sync.duration.deb_ian:1500|ms", receive())
+
+	asrt.NoError(e.EnableStatsD(config.StatsDConfig{Address: conn.LocalAddr().String(), Prefix: "lug", DogStatsD: true}))
+	e.SyncFail("debian", 2*time.Second)
+	asrt.Equal("lug.sync.fail:1|c|#worker:debian\nlug.sync.duration:2000|ms|#worker:debian", receive())
+}
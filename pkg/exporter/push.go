@@ -0,0 +1,180 @@
+package exporter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// pushTimeout limits a push, so that a hanging Pushgateway never blocks later pushes
+const pushTimeout = 30 * time.Second
+
+// pushGateway pushes the whole registry to a Prometheus Pushgateway
+type pushGateway struct {
+	pusher *push.Pusher
+	// stop is closed when pushing is disabled
+	stop chan struct{}
+	// pushing is whether a push is in flight, and pending is whether another push is asked
+	// during it. Pusher is not safe for concurrent use, and pushes should not overlap anyway
+	pushing bool
+	pending bool
+	mutex   sync.Mutex
+	// idle is signaled when pushing becomes false
+	idle *sync.Cond
+}
+
+// push pushes metrics synchronously, replacing all metrics of the job on the Pushgateway.
+// If a push is in flight, it is asked to push once more after it finishes instead
+func (p *pushGateway) push() {
+	p.mutex.Lock()
+	if p.pushing {
+		p.pending = true
+		p.mutex.Unlock()
+		return
+	}
+	p.pushing = true
+	p.mutex.Unlock()
+	for {
+		if err := p.pusher.Push(); err != nil {
+			moduleLogger.WithField("event", "push_metrics_failed").Warn(err)
+		} else {
+			moduleLogger.WithField("event", "push_metrics").Debug("Metrics pushed to Pushgateway")
+		}
+		p.mutex.Lock()
+		if !p.pending {
+			p.pushing = false
+			p.idle.Broadcast()
+			p.mutex.Unlock()
+			return
+		}
+		p.pending = false
+		p.mutex.Unlock()
+	}
+}
+
+// wait blocks until no push is in flight
+func (p *pushGateway) wait() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.pushing {
+		p.idle.Wait()
+	}
+}
+
+// pushEvery pushes metrics every interval until pushing is disabled
+func (p *pushGateway) pushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.push()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// EnablePushGateway starts pushing metrics to the configured Pushgateway after each
+// sync, and every Interval seconds if it is positive
+func (e *Exporter) EnablePushGateway(cfg config.PushGatewayConfig) {
+	p := &pushGateway{
+		pusher: push.New(cfg.URL, cfg.Job).Gatherer(prometheus.DefaultGatherer).
+			Client(&http.Client{Timeout: pushTimeout}),
+		stop: make(chan struct{}),
+	}
+	p.idle = sync.NewCond(&p.mutex)
+	e.mutex.Lock()
+	e.disablePushGateway()
+	e.pushGateway = p
+	e.mutex.Unlock()
+	if cfg.Interval > 0 {
+		go p.pushEvery(time.Duration(cfg.Interval) * time.Second)
+	}
+}
+
+// DisablePushGateway stops pushing metrics after pushing them for the last time, e.g. on
+// exit, and blocks until pushes finish
+func (e *Exporter) DisablePushGateway() {
+	e.mutex.Lock()
+	p := e.pushGateway
+	e.disablePushGateway()
+	e.mutex.Unlock()
+	if p != nil {
+		// gathering metrics needs mutex of exporter, so push after it is released
+		p.push()
+		p.wait()
+	}
+}
+
+// disablePushGateway stops pushing metrics. Call it with mutex held
+func (e *Exporter) disablePushGateway() {
+	if e.pushGateway != nil {
+		close(e.pushGateway.stop)
+		e.pushGateway = nil
+	}
+}
+
+// statsdName matches characters which are not safe in a StatsD metric name
+var statsdName = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// statsdClient emits sync events as StatsD packets over UDP
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	// dogstatsd puts worker into tags instead of metric names
+	dogstatsd bool
+}
+
+// EnableStatsD starts emitting sync events to the configured StatsD server
+func (e *Exporter) EnableStatsD(cfg config.StatsDConfig) error {
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.statsd = &statsdClient{
+		conn:      conn,
+		prefix:    cfg.Prefix,
+		dogstatsd: cfg.DogStatsD,
+	}
+	return nil
+}
+
+// format formats a StatsD line of worker, e.g. lug.sync.success.debian:1|c
+func (s *statsdClient) format(worker string, name string, value string) string {
+	if s.dogstatsd {
+		return fmt.Sprintf("%s.sync.%s:%s|#worker:%s", s.prefix, name, value, worker)
+	}
+	return fmt.Sprintf("%s.sync.%s.%s:%s", s.prefix, name, statsdName.ReplaceAllString(worker, "_"), value)
+}
+
+// syncFinished sends the result and duration of a sync in a single packet. Errors are
+// only logged since UDP delivery is best effort
+func (s *statsdClient) syncFinished(worker string, result string, duration time.Duration) {
+	packet := s.format(worker, result, "1|c") + "\n" +
+		s.format(worker, "duration", fmt.Sprintf("%d|ms", duration.Milliseconds()))
+	if _, err := s.conn.Write([]byte(packet)); err != nil {
+		moduleLogger.WithField("event", "statsd_failed").Warn(err)
+	}
+}
+
+// pushSyncFinished reports a finished sync to push targets. Call it with mutex held
+func (e *Exporter) pushSyncFinished(worker string, result string, duration time.Duration) {
+	if e.statsd != nil {
+		e.statsd.syncFinished(worker, result, duration)
+	}
+	if e.pushGateway != nil {
+		// gathering metrics needs mutex of exporter, so push in background
+		go e.pushGateway.push()
+	}
+}
@@ -0,0 +1,208 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// scriptMetricPrefix is prepended to names of metrics reported by scripts
+const scriptMetricPrefix = "lug_script_"
+
+// ScriptMetric is a metric reported by a sync script
+type ScriptMetric struct {
+	Name   string
+	Labels map[string]string `json:",omitempty"`
+	Value  float64
+}
+
+var keyValueLine = regexp.MustCompile(`^\s*([^=\s]+)\s*=\s*(\S+)\s*$`)
+
+// ParseScriptMetrics parses metrics written by scripts. Both Prometheus text format and
+// key=value lines are accepted, where the latter is used if every non-comment line is
+// key=value. Only gauges, counters and untyped metrics are accepted from Prometheus text.
+func ParseScriptMetrics(in io.Reader) ([]ScriptMetric, error) {
+	content, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []ScriptMetric
+	isKeyValue := true
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		match := keyValueLine.FindStringSubmatch(line)
+		if match == nil {
+			isKeyValue = false
+			break
+		}
+		value, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %w", match[1], err)
+		}
+		metrics = append(metrics, ScriptMetric{Name: match[1], Value: value})
+	}
+	if !isKeyValue {
+		metrics, err = parsePrometheusText(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, metric := range metrics {
+		if err := metric.validate(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].String() < metrics[j].String()
+	})
+	return metrics, nil
+}
+
+func parsePrometheusText(content []byte) ([]ScriptMetric, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	var metrics []ScriptMetric
+	for name, family := range families {
+		for _, m := range family.GetMetric() {
+			var value float64
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				return nil, fmt.Errorf("unsupported type of %s: %s", name, family.GetType())
+			}
+			labels := map[string]string{}
+			for _, pair := range m.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			metrics = append(metrics, ScriptMetric{Name: name, Labels: labels, Value: value})
+		}
+	}
+	return metrics, nil
+}
+
+func (m ScriptMetric) validate() error {
+	if !model.IsValidLegacyMetricName(m.Name) {
+		return fmt.Errorf("invalid metric name %q", m.Name)
+	}
+	for name := range m.Labels {
+		if !model.LabelName(name).IsValidLegacy() {
+			return fmt.Errorf("invalid label name %q of %s", name, m.Name)
+		}
+		if name == "worker" {
+			return errors.New("label worker is reserved, found in " + m.Name)
+		}
+	}
+	return nil
+}
+
+// labelNames returns sorted names of labels
+func (m ScriptMetric) labelNames() []string {
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String formats metric in Prometheus text format, e.g. files_added{dir="pool"} 3
+func (m ScriptMetric) String() string {
+	var labels []string
+	for _, name := range m.labelNames() {
+		labels = append(labels, fmt.Sprintf("%s=%q", name, m.Labels[name]))
+	}
+	if len(labels) == 0 {
+		return fmt.Sprintf("%s %v", m.Name, m.Value)
+	}
+	return fmt.Sprintf("%s{%s} %v", m.Name, strings.Join(labels, ","), m.Value)
+}
+
+// FormatScriptMetrics formats metrics in Prometheus text format, one line per metric
+func FormatScriptMetrics(metrics []ScriptMetric) []string {
+	lines := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		lines = append(lines, m.String())
+	}
+	return lines
+}
+
+// scriptMetricsCollector collects metrics reported by scripts of all workers
+type scriptMetricsCollector struct {
+	e *Exporter
+}
+
+// Describe sends nothing, so that the collector is unchecked since metrics are only known at runtime
+func (c scriptMetricsCollector) Describe(chan<- *prometheus.Desc) {
+}
+
+func (c scriptMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.mutex.Lock()
+	defer c.e.mutex.Unlock()
+	workers := make([]string, 0, len(c.e.scriptMetrics))
+	for worker := range c.e.scriptMetrics {
+		workers = append(workers, worker)
+	}
+	sort.Strings(workers)
+	// metrics of the same name must have the same label names in Prometheus
+	labelNamesOf := map[string]string{}
+	for _, worker := range workers {
+		for _, m := range c.e.scriptMetrics[worker] {
+			name := scriptMetricPrefix + m.Name
+			labelNames := m.labelNames()
+			joined := strings.Join(labelNames, ",")
+			if expected, ok := labelNamesOf[name]; ok && expected != joined {
+				moduleLogger.WithFields(log.Fields{
+					"event":  "inconsistent_script_metric",
+					"worker": worker,
+					"metric": name,
+				}).Warn("Script metric dropped since its labels differ from other workers")
+				continue
+			}
+			labelNamesOf[name] = joined
+			labelValues := make([]string, 0, len(labelNames)+1)
+			for _, labelName := range labelNames {
+				labelValues = append(labelValues, m.Labels[labelName])
+			}
+			labelValues = append(labelValues, worker)
+			desc := prometheus.NewDesc(name, "Metric reported by sync script, partitioned by workers.",
+				append(labelNames, "worker"), nil)
+			metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.Value, labelValues...)
+			if err != nil {
+				moduleLogger.WithField("event", "invalid_script_metric").Warn(err)
+				continue
+			}
+			ch <- metric
+		}
+	}
+}
+
+// SetScriptMetrics replaces metrics reported by the script of worker
+func (e *Exporter) SetScriptMetrics(worker string, metrics []ScriptMetric) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.scriptMetrics[worker] = metrics
+}
@@ -1,35 +1,135 @@
 package helper
 
 import (
+	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
-// DiskUsage counts the disk usage of a directory. The call is synchronous
-func DiskUsage(curPath string) (int64, error) {
-	var size int64
+// diskUsageConcurrency is the maximum number of directories read at the same time
+const diskUsageConcurrency = 16
 
-	dir, err := os.Open(curPath)
-	if err != nil {
-		return size, err
+// DiskUsageResult is the result of DiskUsage
+type DiskUsageResult struct {
+	// Bytes allocated on disk. Hardlinked files are counted only once
+	Bytes int64
+	// Files counts non-directory entries, including symlinks
+	Files int64
+	// Dirs counts directories, including the root
+	Dirs int64
+	// Skipped counts entries which cannot be read, e.g. due to permission
+	Skipped int64
+}
+
+type diskUsageWalker struct {
+	// device of root, other filesystems mounted under root are not counted
+	dev     uint64
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	bytes   atomic.Int64
+	files   atomic.Int64
+	dirs    atomic.Int64
+	skipped atomic.Int64
+	// inodes of hardlinked files seen
+	inodes     map[uint64]struct{}
+	inodesLock sync.Mutex
+}
+
+// DiskUsage counts the disk usage of a directory. The call is synchronous, but
+// directories are walked concurrently. It neither follows symlinks nor crosses
+// filesystems, and unreadable entries are skipped instead of aborting the scan.
+func DiskUsage(root string) (DiskUsageResult, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(root, &st); err != nil {
+		return DiskUsageResult{}, &os.PathError{Op: "lstat", Path: root, Err: err}
 	}
-	defer dir.Close()
+	w := &diskUsageWalker{
+		dev:    uint64(st.Dev),
+		sem:    make(chan struct{}, diskUsageConcurrency),
+		inodes: map[uint64]struct{}{},
+	}
+	w.count(&st)
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		w.walk(root)
+		w.wg.Wait()
+	}
+	return DiskUsageResult{
+		Bytes:   w.bytes.Load(),
+		Files:   w.files.Load(),
+		Dirs:    w.dirs.Load(),
+		Skipped: w.skipped.Load(),
+	}, nil
+}
 
-	files, err := dir.Readdir(-1)
-	if err != nil {
-		return size, err
+// count adds an entry into result
+func (w *diskUsageWalker) count(st *syscall.Stat_t) {
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		w.dirs.Add(1)
+	} else {
+		if st.Nlink > 1 {
+			w.inodesLock.Lock()
+			_, seen := w.inodes[st.Ino]
+			w.inodes[st.Ino] = struct{}{}
+			w.inodesLock.Unlock()
+			if seen {
+				return
+			}
+		}
+		w.files.Add(1)
 	}
+	// st.Blocks is always in 512-byte units, so sparse files are counted by allocated size
+	w.bytes.Add(int64(st.Blocks) * 512)
+}
+
+// spawn walks the directory in a new goroutine if concurrency allows, otherwise in current one
+func (w *diskUsageWalker) spawn(path string) {
+	select {
+	case w.sem <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer func() { <-w.sem }()
+			w.walk(path)
+		}()
+	default:
+		w.walk(path)
+	}
+}
 
-	for _, file := range files {
-		if file.IsDir() {
-			s, err := DiskUsage(path.Join(curPath, file.Name()))
-			if err != nil {
-				return size, err
+// walk reads the directory in batches, so huge directories are not loaded into memory at once
+func (w *diskUsageWalker) walk(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		w.skipped.Add(1)
+		return
+	}
+	defer dir.Close()
+	for {
+		entries, err := dir.ReadDir(1024)
+		for _, entry := range entries {
+			child := filepath.Join(path, entry.Name())
+			var st syscall.Stat_t
+			if err := syscall.Lstat(child, &st); err != nil {
+				w.skipped.Add(1)
+				continue
+			}
+			if uint64(st.Dev) != w.dev {
+				continue
+			}
+			w.count(&st)
+			if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				w.spawn(child)
 			}
-			size += s
-		} else {
-			size += file.Size()
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			w.skipped.Add(1)
+			return
 		}
 	}
-	return size, nil
 }
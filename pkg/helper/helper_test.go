@@ -1,10 +1,24 @@
 package helper
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/sjtug/lug/pkg/config"
 )
 
 func TestMaxLengthStringSliceAdaptor(t *testing.T) {
@@ -57,7 +71,176 @@ func TestMaxLengthSlice(t *testing.T) {
 
 func TestDiskUsage(t *testing.T) {
 	asrt := assert.New(t)
-	size, err := DiskUsage(".")
+	usage, err := DiskUsage(".")
 	asrt.True(err == nil)
-	asrt.True(size > 0)
+	asrt.True(usage.Bytes > 0)
+	asrt.True(usage.Files > 0)
+	asrt.True(usage.Dirs > 0)
+
+	_, err = DiskUsage("/nonexistent")
+	asrt.Error(err)
+}
+
+func TestDiskUsageHardlinkAndSparse(t *testing.T) {
+	asrt := assert.New(t)
+	dir := t.TempDir()
+	asrt.NoError(os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = 5
+	}
+	asrt.NoError(os.WriteFile(filepath.Join(dir, "a", "file"), content, 0644))
+	single, err := DiskUsage(dir)
+	asrt.NoError(err)
+	asrt.GreaterOrEqual(single.Bytes, int64(1<<20))
+	asrt.EqualValues(1, single.Files)
+	asrt.EqualValues(3, single.Dirs)
+
+	// hardlinks are counted once
+	asrt.NoError(os.Link(filepath.Join(dir, "a", "file"), filepath.Join(dir, "a", "b", "link")))
+	linked, err := DiskUsage(dir)
+	asrt.NoError(err)
+	asrt.Equal(single.Bytes, linked.Bytes)
+	asrt.EqualValues(1, linked.Files)
+
+	// sparse files are counted by allocated blocks
+	sparse, err := os.Create(filepath.Join(dir, "sparse"))
+	asrt.NoError(err)
+	asrt.NoError(sparse.Truncate(1 << 30))
+	sparse.Close()
+	withSparse, err := DiskUsage(dir)
+	asrt.NoError(err)
+	asrt.EqualValues(2, withSparse.Files)
+	asrt.Less(withSparse.Bytes, single.Bytes+(1<<20))
+}
+
+func TestDiskUsageSkipsUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	asrt := assert.New(t)
+	dir := t.TempDir()
+	asrt.NoError(os.MkdirAll(filepath.Join(dir, "locked", "inner"), 0755))
+	asrt.NoError(os.WriteFile(filepath.Join(dir, "file"), []byte("lug"), 0644))
+	asrt.NoError(os.Chmod(filepath.Join(dir, "locked"), 0))
+	defer os.Chmod(filepath.Join(dir, "locked"), 0755)
+
+	usage, err := DiskUsage(dir)
+	asrt.NoError(err)
+	asrt.EqualValues(1, usage.Skipped)
+	asrt.EqualValues(1, usage.Files)
+	asrt.EqualValues(2, usage.Dirs)
+}
+
+func TestListenUnix(t *testing.T) {
+	asrt := assert.New(t)
+	path := filepath.Join(t.TempDir(), "lug.sock")
+	// a stale socket should be replaced
+	stale, err := net.Listen("unix", path)
+	asrt.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, reloader, err := Listen(config.ListenerConfig{
+		Address:    "unix:" + path,
+		SocketMode: "0600",
+	})
+	asrt.NoError(err)
+	asrt.Nil(reloader)
+	defer l.Close()
+	info, err := os.Stat(path)
+	asrt.NoError(err)
+	asrt.EqualValues(0600, info.Mode().Perm())
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Write([]byte("lug"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	asrt.NoError(err)
+	buf := make([]byte, 3)
+	_, err = conn.Read(buf)
+	asrt.NoError(err)
+	asrt.Equal("lug", string(buf))
+	conn.Close()
+}
+
+// writeSelfSignedCert generates a self-signed certificate with given common name
+func writeSelfSignedCert(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenTLSReload(t *testing.T) {
+	asrt := assert.New(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile, "first")
+
+	l, reloader, err := Listen(config.ListenerConfig{
+		Address:  "127.0.0.1:0",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	asrt.NoError(err)
+	if !asrt.NotNil(reloader) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	peerName := func() string {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if !asrt.NoError(err) {
+			return ""
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	asrt.Equal("first", peerName())
+
+	writeSelfSignedCert(t, certFile, keyFile, "second")
+	asrt.NoError(reloader.Reload())
+	asrt.Equal("second", peerName())
+
+	// a broken key pair keeps the old certificate
+	asrt.NoError(os.WriteFile(keyFile, []byte("broken"), 0600))
+	asrt.Error(reloader.Reload())
+	asrt.Equal("second", peerName())
 }
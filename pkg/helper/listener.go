@@ -0,0 +1,105 @@
+package helper
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// CertReloader holds a TLS certificate which can be reloaded from disk at runtime
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	lock     sync.RWMutex
+}
+
+// NewCertReloader loads the key pair and returns a CertReloader of it
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	result := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := result.Reload(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Reload reads the key pair again. The old certificate is kept if it fails
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// GetCertificate could be used as tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// Listen creates a listener described by cfg. If TLS is enabled in cfg, the returned
+// listener is wrapped with TLS and the CertReloader of it is returned, otherwise the
+// CertReloader is nil.
+func Listen(cfg config.ListenerConfig) (net.Listener, *CertReloader, error) {
+	var l net.Listener
+	var err error
+	if cfg.IsUnix() {
+		l, err = listenUnix(cfg)
+	} else {
+		l, err = net.Listen("tcp", cfg.Address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.CertFile == "" {
+		return l, nil, nil
+	}
+	reloader, err := NewCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+	}), reloader, nil
+}
+
+func listenUnix(cfg config.ListenerConfig) (net.Listener, error) {
+	path := cfg.SocketPath()
+	mode, err := cfg.FileMode()
+	if err != nil {
+		return nil, err
+	}
+	// remove the stale socket left by last run, but never other kinds of files
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
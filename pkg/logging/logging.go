@@ -0,0 +1,100 @@
+// Package logging provides loggers of lug modules, and sets up their format and destination
+package logging
+
+import (
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+var (
+	loggers     = map[string]*logrus.Logger{}
+	loggersLock sync.Mutex
+)
+
+// Logger returns the logger of module, e.g. worker. Loggers are created on first use, and
+// share format and destination with the standard logger of logrus after Setup
+func Logger(module string) *logrus.Logger {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+	logger, ok := loggers[module]
+	if !ok {
+		logger = logrus.New()
+		std := logrus.StandardLogger()
+		logger.SetOutput(std.Out)
+		logger.SetFormatter(std.Formatter)
+		logger.SetLevel(std.GetLevel())
+		loggers[module] = logger
+	}
+	return logger
+}
+
+// allLoggers returns the standard logger and loggers of all modules in config.LogModules
+func allLoggers() []*logrus.Logger {
+	result := []*logrus.Logger{logrus.StandardLogger()}
+	for _, module := range config.LogModules {
+		result = append(result, Logger(module))
+	}
+	return result
+}
+
+// Setup applies format, destination and levels to the standard logger and loggers of modules.
+// level is used unless overridden in cfg.Levels
+func Setup(cfg config.LogConfig, level logrus.Level) error {
+	var formatter logrus.Formatter
+	switch cfg.Format {
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	case "logfmt":
+		formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	default:
+		formatter = &logrus.TextFormatter{}
+	}
+	var out io.Writer = os.Stderr
+	var hook logrus.Hook
+	switch cfg.Output {
+	case "file":
+		file, err := newRotatingFile(cfg.File)
+		if err != nil {
+			return err
+		}
+		out = file
+	case "syslog":
+		tag := cfg.Syslog.Tag
+		if tag == "" {
+			tag = "lug"
+		}
+		syslogHook, err := logrus_syslog.NewSyslogHook(cfg.Syslog.Network, cfg.Syslog.Address,
+			syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+		if err != nil {
+			return err
+		}
+		out = io.Discard
+		hook = syslogHook
+	}
+	for _, logger := range allLoggers() {
+		logger.SetFormatter(formatter)
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+		if hook != nil {
+			logger.AddHook(hook)
+		}
+	}
+	for module, moduleLevel := range cfg.Levels {
+		Logger(module).SetLevel(moduleLevel)
+	}
+	return nil
+}
+
+// AddHook adds hook to the standard logger and loggers of all modules
+func AddHook(hook logrus.Hook) {
+	for _, logger := range allLoggers() {
+		logger.AddHook(hook)
+	}
+}
@@ -0,0 +1,191 @@
+package logging
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+func TestSetupFile(t *testing.T) {
+	asrt := assert.New(t)
+	path := filepath.Join(t.TempDir(), "lug.log")
+	asrt.NoError(Setup(config.LogConfig{
+		Format: "json",
+		Output: "file",
+		File:   config.LogFileConfig{Path: path},
+		Levels: map[string]logrus.Level{"worker": logrus.DebugLevel},
+	}, logrus.InfoLevel))
+	Logger("worker").WithField("worker", "debian").Debug("worker debug")
+	Logger("manager").Debug("manager debug")
+	Logger("manager").Info("manager info")
+
+	content, err := os.ReadFile(path)
+	asrt.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if asrt.Len(lines, 2) {
+		var entry map[string]interface{}
+		asrt.NoError(json.Unmarshal([]byte(lines[0]), &entry))
+		asrt.Equal("worker debug", entry["msg"])
+		asrt.Equal("debian", entry["worker"])
+		asrt.Contains(lines[1], "manager info")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	asrt := assert.New(t)
+	path := filepath.Join(t.TempDir(), "lug.log")
+	f, err := newRotatingFile(config.LogFileConfig{Path: path, MaxBackups: 1})
+	asrt.NoError(err)
+	f.maxSize = 10
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		_, err := f.Write([]byte(line))
+		asrt.NoError(err)
+		time.Sleep(2 * time.Millisecond)
+	}
+	content, err := os.ReadFile(path)
+	asrt.NoError(err)
+	asrt.Equal("third\n", string(content))
+	backups, err := filepath.Glob(path + ".*")
+	asrt.NoError(err)
+	if asrt.Len(backups, 1) {
+		content, err = os.ReadFile(backups[0])
+		asrt.NoError(err)
+		asrt.Equal("second\n", string(content))
+	}
+
+	f.maxSize = 0
+	f.maxAge = time.Millisecond
+	_, err = f.Write([]byte("fourth\n"))
+	asrt.NoError(err)
+	content, err = os.ReadFile(path)
+	asrt.NoError(err)
+	asrt.Equal("fourth\n", string(content))
+}
+
+func TestSetupSyslog(t *testing.T) {
+	asrt := assert.New(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	asrt.NoError(err)
+	defer conn.Close()
+	asrt.NoError(Setup(config.LogConfig{
+		Format: "logfmt",
+		Output: "syslog",
+		Syslog: config.LogSyslogConfig{Network: "udp", Address: conn.LocalAddr().String()},
+	}, logrus.InfoLevel))
+	defer logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+
+	Logger("exporter").WithField("event", "test").Info("hello syslog")
+	buf := make([]byte, 1024)
+	asrt.NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	asrt.NoError(err)
+	asrt.Contains(string(buf[:n]), "lug")
+	asrt.Contains(string(buf[:n]), `msg="hello syslog" event=test`)
+}
+
+// lokiStandIn is a local stand-in of Loki push API, which fails the first failures pushes
+type lokiStandIn struct {
+	server   *httptest.Server
+	failures int32
+	pushes   chan lokiPush
+}
+
+type lokiPush struct {
+	TenantID string
+	Streams  []lokiStream
+}
+
+func newLokiStandIn(failures int32) *lokiStandIn {
+	s := &lokiStandIn{failures: failures, pushes: make(chan lokiPush, 100)}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&s.failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var push lokiPush
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		push.TenantID = r.Header.Get("X-Scope-OrgID")
+		s.pushes <- push
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func TestLokiClient(t *testing.T) {
+	asrt := assert.New(t)
+	lokiBackoff = time.Millisecond
+	standIn := newLokiStandIn(2)
+	defer standIn.server.Close()
+	client := NewLokiClient(config.LokiConfig{
+		URL:        standIn.server.URL,
+		TenantID:   "mirror",
+		Labels:     map[string]string{"host": "mirror1"},
+		BatchSize:  2,
+		BatchWait:  60,
+		MaxRetries: 3,
+	})
+	now := time.Unix(1600000000, 0)
+	client.Push(map[string]string{"stream": "stdout"}, now, "a")
+	client.Push(map[string]string{"stream": "stderr"}, now, "b")
+	client.Push(map[string]string{"stream": "stdout"}, now, "c")
+	client.Flush()
+
+	// the first batch is retried after 2 failures
+	push := <-standIn.pushes
+	asrt.Equal("mirror", push.TenantID)
+	asrt.Equal([]lokiStream{
+		{Stream: map[string]string{"host": "mirror1", "stream": "stdout"}, Values: [][2]string{{"1600000000000000000", "a"}}},
+		{Stream: map[string]string{"host": "mirror1", "stream": "stderr"}, Values: [][2]string{{"1600000000000000000", "b"}}},
+	}, push.Streams)
+	push = <-standIn.pushes
+	asrt.Equal([]lokiStream{
+		{Stream: map[string]string{"host": "mirror1", "stream": "stdout"}, Values: [][2]string{{"1600000000000000000", "c"}}},
+	}, push.Streams)
+}
+
+func TestEnableLoki(t *testing.T) {
+	asrt := assert.New(t)
+	standIn := newLokiStandIn(0)
+	defer standIn.server.Close()
+	// nothing to flush before Loki is enabled
+	FlushLoki()
+	EnableLoki(config.LokiConfig{URL: standIn.server.URL, BatchSize: 100, BatchWait: 60})
+	defer func() {
+		lokiClientLock.Lock()
+		lokiClient = nil
+		lokiClientLock.Unlock()
+		for _, logger := range allLoggers() {
+			logger.ReplaceHooks(logrus.LevelHooks{})
+		}
+	}()
+
+	Logger("worker").SetLevel(logrus.InfoLevel)
+	Logger("worker").WithField("worker", "debian").Info("sync started")
+	ShipOutput("debian", "0123abcd", "stdout", "line 1\nline 2\n")
+	FlushLoki()
+
+	push := <-standIn.pushes
+	if asrt.Len(push.Streams, 2) {
+		asrt.Equal(map[string]string{"source": "lug", "level": "info", "worker": "debian"}, push.Streams[0].Stream)
+		asrt.Contains(push.Streams[0].Values[0][1], `"msg":"sync started"`)
+		asrt.Equal(map[string]string{"source": "output", "worker": "debian", "run_id": "0123abcd", "stream": "stdout"}, push.Streams[1].Stream)
+		asrt.Equal("line 1", push.Streams[1].Values[0][1])
+		asrt.Equal("line 2", push.Streams[1].Values[1][1])
+		asrt.Less(push.Streams[1].Values[0][0], push.Streams[1].Values[1][0])
+	}
+}
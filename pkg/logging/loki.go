@@ -0,0 +1,254 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// lokiEntry is a line waiting to be pushed
+type lokiEntry struct {
+	labels map[string]string
+	time   time.Time
+	line   string
+}
+
+// lokiStream is a stream in request of Loki push API
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// LokiClient pushes lines to Grafana Loki in batches. Lines are dropped rather than blocking
+// callers when Loki is too slow, and failed pushes are retried with exponential backoff.
+// Errors are written to stderr, since logging them would feed them back to Loki
+type LokiClient struct {
+	cfg     config.LokiConfig
+	client  *http.Client
+	entries chan lokiEntry
+	flush   chan chan struct{}
+}
+
+// lokiBackoff is the initial delay before retrying a failed push
+var lokiBackoff = 500 * time.Millisecond
+
+// NewLokiClient creates a client and starts pushing in background
+func NewLokiClient(cfg config.LokiConfig) *LokiClient {
+	c := &LokiClient{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		entries: make(chan lokiEntry, 10*cfg.BatchSize),
+		flush:   make(chan chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Push queues a line with labels, which are merged with labels in config
+func (c *LokiClient) Push(labels map[string]string, t time.Time, line string) {
+	merged := map[string]string{}
+	for k, v := range c.cfg.Labels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	select {
+	case c.entries <- lokiEntry{labels: merged, time: t, line: line}:
+	default:
+		fmt.Fprintln(os.Stderr, "loki: queue is full, line dropped")
+	}
+}
+
+// Flush pushes all queued lines, and blocks until it finishes
+func (c *LokiClient) Flush() {
+	done := make(chan struct{})
+	c.flush <- done
+	<-done
+}
+
+func (c *LokiClient) run() {
+	var batch []lokiEntry
+	ticker := time.NewTicker(time.Duration(c.cfg.BatchWait) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-c.entries:
+			batch = append(batch, entry)
+			if len(batch) >= c.cfg.BatchSize {
+				c.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				c.send(batch)
+				batch = nil
+			}
+		case done := <-c.flush:
+			// drain lines queued before Flush is called
+			for len(c.entries) > 0 {
+				batch = append(batch, <-c.entries)
+			}
+			for len(batch) > 0 {
+				n := min(len(batch), c.cfg.BatchSize)
+				c.send(batch[:n])
+				batch = batch[n:]
+			}
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+// labelsKey serializes labels as key of stream
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%q,", k, labels[k])
+	}
+	return b.String()
+}
+
+// send pushes a batch, retrying on network errors, 429 and 5xx
+func (c *LokiClient) send(batch []lokiEntry) {
+	streams := map[string]*lokiStream{}
+	var keys []string
+	for _, entry := range batch {
+		key := labelsKey(entry.labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: entry.labels}
+			streams[key] = stream
+			keys = append(keys, key)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.time.UnixNano(), 10), entry.line})
+	}
+	request := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		request.Streams = append(request.Streams, streams[key])
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loki: cannot encode batch:", err)
+		return
+	}
+	backoff := lokiBackoff
+	for retry := 0; ; retry++ {
+		retryable, err := c.post(body)
+		if err == nil {
+			return
+		}
+		if !retryable || retry >= c.cfg.MaxRetries {
+			fmt.Fprintf(os.Stderr, "loki: %d lines dropped: %v\n", len(batch), err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends a push request, and returns whether a failure is worth retrying
+func (c *LokiClient) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", c.cfg.TenantID)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5
+	return retryable, fmt.Errorf("push failed with %s", resp.Status)
+}
+
+// lokiHook ships entries of loggers to Loki in JSON, labeled with level, and worker if present
+type lokiHook struct {
+	client    *LokiClient
+	formatter logrus.JSONFormatter
+}
+
+func (h *lokiHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *lokiHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{"source": "lug", "level": entry.Level.String()}
+	if worker, ok := entry.Data["worker"].(string); ok {
+		labels["worker"] = worker
+	}
+	h.client.Push(labels, entry.Time, strings.TrimSuffix(string(line), "\n"))
+	return nil
+}
+
+var (
+	lokiClient     *LokiClient
+	lokiClientLock sync.Mutex
+)
+
+// EnableLoki ships logs of all loggers, and outputs passed to ShipOutput, to Loki
+func EnableLoki(cfg config.LokiConfig) *LokiClient {
+	client := NewLokiClient(cfg)
+	lokiClientLock.Lock()
+	lokiClient = client
+	lokiClientLock.Unlock()
+	AddHook(&lokiHook{client: client})
+	return client
+}
+
+// FlushLoki pushes all lines queued for Loki, and should be called before exiting so that
+// the last lines are not lost. It does nothing if Loki is not enabled
+func FlushLoki() {
+	lokiClientLock.Lock()
+	client := lokiClient
+	lokiClientLock.Unlock()
+	if client != nil {
+		client.Flush()
+	}
+}
+
+// ShipOutput ships stdout or stderr of a run line by line to Loki, labeled with worker,
+// run_id and stream. It does nothing if Loki is not enabled
+func ShipOutput(worker string, runID string, stream string, output string) {
+	lokiClientLock.Lock()
+	client := lokiClient
+	lokiClientLock.Unlock()
+	if client == nil || output == "" {
+		return
+	}
+	labels := map[string]string{"source": "output", "worker": worker, "run_id": runID, "stream": stream}
+	now := time.Now()
+	for i, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		// lines of a stream are ordered by timestamp in Loki, so keep them increasing
+		client.Push(labels, now.Add(time.Duration(i)), line)
+	}
+}
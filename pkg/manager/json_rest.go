@@ -1,11 +1,13 @@
 package manager
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
-	log "github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/worker"
 )
 
 // RestfulAPI is a JSON-like API of given manager
@@ -24,18 +26,29 @@ func NewRestfulAPI(m *Manager) *RestfulAPI {
 func (r *RestfulAPI) GetAPIHandler() http.Handler {
 	api := rest.NewApi()
 	api.Use(rest.DefaultDevStack...)
-	router, err := rest.MakeRouter(
+	routes := []*rest.Route{
 		rest.Get("/lug/v1/admin/manager/detail", r.getManagerStatusDetail),
 		rest.Get("/lug/v1/manager/summary", r.getManagerStatusSummary),
+		rest.Get("/lug/v1/mirrorz", r.getMirrorz),
 		rest.Post("/lug/v1/admin/manager/start", r.startManager),
 		rest.Post("/lug/v1/admin/manager/stop", r.stopManager),
 		rest.Delete("/lug/v1/admin/manager", r.exitManager),
-	)
+		rest.Post("/lug/v1/admin/worker/#name/rollback", r.rollbackWorker),
+		rest.Get("/healthz", r.healthz),
+		rest.Get("/readyz", r.readyz),
+	}
+	if r.manager.config.JsonAPIConfig.Tunasync {
+		routes = append(routes, rest.Get("/jobs", r.getTunasyncJobs))
+	}
+	router, err := rest.MakeRouter(routes...)
 	if err != nil {
-		log.Fatal(err)
+		r.manager.logger.Fatal(err)
 	}
 	api.SetApp(router)
-	return api.MakeHandler()
+	mux := http.NewServeMux()
+	mux.Handle("/", api.MakeHandler())
+	mux.Handle("/status.html", r.manager.StatusPageHandler())
+	return mux
 }
 
 type WorkerStatusSimple struct {
@@ -45,6 +58,12 @@ type WorkerStatusSimple struct {
 	LastFinished time.Time
 	// Idle stands for whether worker is idle, false if syncing
 	Idle bool
+	// DiskUsage is the size of mirror in bytes, 0 if unknown
+	DiskUsage int64
+	// UpstreamUpdated is when upstream data was updated, nil if unknown
+	UpstreamUpdated *time.Time `json:"upstream_updated,omitempty"`
+	// FailReason is why the last run failed after syncing, e.g. verification_failed
+	FailReason string `json:"fail_reason,omitempty"`
 }
 
 type MangerStatusSimple struct {
@@ -65,9 +84,12 @@ func (r *RestfulAPI) getManagerStatusCommon(w rest.ResponseWriter, req *rest.Req
 	// summary mode
 	for workerKey, rawWorkerStatus := range rawStatus.WorkerStatus {
 		managerStatusSimple.WorkerStatus[workerKey] = WorkerStatusSimple{
-			Result:       rawWorkerStatus.Result,
-			LastFinished: rawWorkerStatus.LastFinished,
-			Idle:         rawWorkerStatus.Idle,
+			Result:          rawWorkerStatus.Result,
+			LastFinished:    rawWorkerStatus.LastFinished,
+			Idle:            rawWorkerStatus.Idle,
+			DiskUsage:       rawWorkerStatus.DiskUsage,
+			UpstreamUpdated: rawWorkerStatus.UpstreamUpdated,
+			FailReason:      rawWorkerStatus.FailReason,
 		}
 	}
 	w.WriteJson(managerStatusSimple)
@@ -81,6 +103,14 @@ func (r *RestfulAPI) getManagerStatusSummary(w rest.ResponseWriter, req *rest.Re
 	r.getManagerStatusCommon(w, req, false)
 }
 
+func (r *RestfulAPI) getMirrorz(w rest.ResponseWriter, req *rest.Request) {
+	w.WriteJson(r.manager.GetMirrorz())
+}
+
+func (r *RestfulAPI) getTunasyncJobs(w rest.ResponseWriter, req *rest.Request) {
+	w.WriteJson(r.manager.GetTunasyncJobs())
+}
+
 func (r *RestfulAPI) startManager(w rest.ResponseWriter, req *rest.Request) {
 	r.manager.Start()
 }
@@ -92,3 +122,48 @@ func (r *RestfulAPI) stopManager(w rest.ResponseWriter, req *rest.Request) {
 func (r *RestfulAPI) exitManager(w rest.ResponseWriter, req *rest.Request) {
 	r.manager.Exit()
 }
+
+type RollbackResult struct {
+	// Snapshot is name of the snapshot published by rollback
+	Snapshot string
+}
+
+// rollbackWorker publishes the previous snapshot of a worker
+func (r *RestfulAPI) rollbackWorker(w rest.ResponseWriter, req *rest.Request) {
+	name, err := r.manager.Rollback(req.PathParam("name"))
+	switch {
+	case err == nil:
+		w.WriteJson(RollbackResult{Snapshot: name})
+	case errors.Is(err, ErrWorkerNotFound):
+		rest.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, worker.ErrSnapshotDisabled):
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, worker.ErrSyncing), errors.Is(err, worker.ErrNoPreviousSnapshot):
+		rest.Error(w, err.Error(), http.StatusConflict)
+	default:
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// healthz succeeds as long as the process is alive
+func (r *RestfulAPI) healthz(w rest.ResponseWriter, req *rest.Request) {
+	w.WriteJson(map[string]string{"status": "ok"})
+}
+
+type ReadyStatus struct {
+	Ready bool
+	// Reasons why manager is not ready, empty when ready
+	Reasons []string
+}
+
+// readyz succeeds if the manager is running and checkpoint is writable
+func (r *RestfulAPI) readyz(w rest.ResponseWriter, req *rest.Request) {
+	reasons := r.manager.NotReadyReasons()
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.WriteJson(ReadyStatus{
+		Ready:   len(reasons) == 0,
+		Reasons: reasons,
+	})
+}
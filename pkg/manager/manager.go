@@ -2,17 +2,26 @@
 package manager
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/dustin/go-humanize"
+	"html/template"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
+	"github.com/sjtug/lug/pkg/logging"
+	"github.com/sjtug/lug/pkg/tracing"
 	"github.com/sjtug/lug/pkg/worker"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -40,7 +49,17 @@ type Manager struct {
 	running               bool
 	// storing index of worker to launch
 	pendingQueue []int
-	logger       *logrus.Entry
+	// stores index of worker -> spans of it waiting in pendingQueue
+	pendingTraces map[int]pendingTrace
+	logger        *logrus.Entry
+	// stores listener name -> error which stopped it
+	listenerErrors map[string]string
+	listenerLock   sync.Mutex
+	// guard writes of workersLastInvokeTime and reads outside Run()
+	invokeTimeLock sync.RWMutex
+	// stores worker name -> LastEnded seen in last polling, to find finished syncs
+	workersLastEnded map[string]time.Time
+	statusPage       *template.Template
 }
 
 // Status holds the status of a manager and its workers
@@ -48,18 +67,73 @@ type Manager struct {
 type Status struct {
 	Running      bool
 	WorkerStatus map[string]worker.Status
+	// ListenerErrors: key = listener's name, value = error which stopped it
+	ListenerErrors map[string]string
+}
+
+// pendingTrace holds spans of a worker waiting in pendingQueue
+type pendingTrace struct {
+	// ctx carries the span of the whole sync, which is ended by the worker
+	ctx       context.Context
+	queueWait trace.Span
 }
 
 type WorkerCheckPoint struct {
 	LastInvokeTime time.Time  `json:"last_invoke_time"`
 	LastFinished   *time.Time `json:"last_finished,omitempty"`
 	Result         *bool      `json:"result,omitempty"`
+	// State of the worker if it is a worker.Checkpointer, e.g. last synced serial of pypi worker
+	State map[string]string `json:"state,omitempty"`
 }
 
 type CheckPoint struct {
 	WorkerInfo map[string]WorkerCheckPoint `json:"worker_info"`
 }
 
+// defaultWorkerInterval is used if "interval" is not specified, so worker will launch once a year
+const defaultWorkerInterval = 31536000
+
+// workerInterval returns interval between synchronizations of a worker in seconds
+func workerInterval(cfg config.RepoConfig) int {
+	if interval, ok := cfg["interval"].(int); ok {
+		return interval
+	}
+	return defaultWorkerInterval
+}
+
+// nextInvokeTime returns when a worker invoked at lastInvokeTime is due, which is now if it
+// has never been invoked
+func nextInvokeTime(lastInvokeTime time.Time, interval int) time.Time {
+	if lastInvokeTime.IsZero() {
+		return time.Now()
+	}
+	return lastInvokeTime.Add(time.Duration(interval) * time.Second)
+}
+
+// defaultDiskUsageInterval is used if "disk_usage_interval" is not specified
+const defaultDiskUsageInterval = 3600
+
+// refreshDiskUsage rescans disk usage of "path" of a worker periodically
+func refreshDiskUsage(cfg config.RepoConfig) {
+	path, ok := cfg["path"].(string)
+	if !ok {
+		return
+	}
+	interval, ok := cfg["disk_usage_interval"].(int)
+	if !ok {
+		interval = defaultDiskUsageInterval
+	}
+	exporter.GetInstance().RefreshDiskUsage(cfg["name"].(string), path, time.Duration(interval)*time.Second)
+}
+
+// formatSize formats disk usage for human, or returns "unknown" if it has not been scanned
+func formatSize(size int64) string {
+	if size <= 0 {
+		return "unknown"
+	}
+	return humanize.IBytes(uint64(size))
+}
+
 // fromCheckpoint laods last invoke time from json
 func fromCheckpoint(checkpointFile string) (*CheckPoint, error) {
 	jsonFile, err := os.Open(checkpointFile)
@@ -100,12 +174,19 @@ func workerFromCheckpoint(repoConfig config.RepoConfig, checkpoint *CheckPoint,
 	if info.LastFinished != nil {
 		lastFinished = *info.LastFinished
 	}
-	return worker.NewWorker(repoConfig, lastFinished, result)
+	w, err := worker.NewWorker(repoConfig, lastFinished, result)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := w.(worker.Checkpointer); ok && info.State != nil {
+		c.RestoreState(info.State)
+	}
+	return w, nil
 }
 
 // NewManager creates a new manager with attached workers from config
 func NewManager(config *config.Config) (*Manager, error) {
-	logger := logrus.WithField("manager", "")
+	logger := logging.Logger("manager").WithField("manager", "")
 	checkpoint, err := fromCheckpoint(config.Checkpoint)
 	workersLastInvokeTime := make(map[string]time.Time)
 	if err != nil {
@@ -115,6 +196,10 @@ func NewManager(config *config.Config) (*Manager, error) {
 			workersLastInvokeTime[name] = info.LastInvokeTime
 		}
 	}
+	statusPage, err := newStatusPageTemplate(config.StatusPageConfig)
+	if err != nil {
+		return nil, err
+	}
 	newManager := Manager{
 		config:                config,
 		workers:               []worker.Worker{},
@@ -123,21 +208,31 @@ func NewManager(config *config.Config) (*Manager, error) {
 		finishChan:            make(chan int),
 		running:               true,
 		logger:                logger,
+		listenerErrors:        map[string]string{},
+		pendingTraces:         map[int]pendingTrace{},
+		workersLastEnded:      map[string]time.Time{},
+		statusPage:            statusPage,
 	}
 	for _, repoConfig := range config.Repos {
 		if disabled, ok := repoConfig["disabled"].(bool); ok && disabled {
 			continue
 		}
 		name, _ := repoConfig["name"].(string)
-		if _, ok := newManager.workersLastInvokeTime[name]; !ok {
-			newManager.workersLastInvokeTime[name] = time.Now().AddDate(-1, 0, 0)
-		}
+		// workers never invoked have zero time, which makes them overdue at once
 		w, err := workerFromCheckpoint(repoConfig, checkpoint, name, newManager.workersLastInvokeTime[name])
 		if err != nil {
 			return nil, err
 		}
 		newManager.workers = append(newManager.workers, w)
+		exporter.GetInstance().SetWorkerInterval(name, time.Duration(workerInterval(repoConfig))*time.Second)
+		// only restore the time of last success really recorded in checkpoint
+		if checkpoint != nil && repoConfig["type"] != "external" {
+			if info, ok := checkpoint.WorkerInfo[name]; ok && info.LastFinished != nil {
+				exporter.GetInstance().SetLastSuccess(name, *info.LastFinished)
+			}
+		}
 	}
+	exporter.GetInstance().SetManagerRunning(newManager.running)
 	return &newManager, nil
 }
 
@@ -146,16 +241,15 @@ func (m *Manager) checkpoint() error {
 	for _, w := range m.workers {
 		name := w.GetConfig()["name"].(string)
 		status := w.GetStatus()
-		lastInvokeTime, ok := m.workersLastInvokeTime[name]
-		if !ok {
-			lastInvokeTime = time.Now().AddDate(-1, 0, 0)
-		}
-
-		ckptObj.WorkerInfo[name] = WorkerCheckPoint{
-			LastInvokeTime: lastInvokeTime,
+		info := WorkerCheckPoint{
+			LastInvokeTime: m.workersLastInvokeTime[name],
 			Result:         &status.Result,
 			LastFinished:   &status.LastFinished,
 		}
+		if c, ok := w.(worker.Checkpointer); ok {
+			info.State = c.CheckpointState()
+		}
+		ckptObj.WorkerInfo[name] = info
 	}
 
 	file, err := json.MarshalIndent(ckptObj, "", "  ")
@@ -209,11 +303,26 @@ func (m *Manager) launchWorkerFromPendingQueue(max_allowed int) {
 			"event":              "trigger_sync",
 			"target_worker_name": wConfig["name"],
 		}).Infof("trigger sync for worker %s from pendingQueue", wConfig["name"])
+		m.invokeTimeLock.Lock()
 		m.workersLastInvokeTime[wConfig["name"].(string)] = time.Now()
-		w.TriggerSync()
+		m.invokeTimeLock.Unlock()
+		pending := m.pendingTraces[w_idx]
+		delete(m.pendingTraces, w_idx)
+		pending.queueWait.End()
+		w.TriggerSyncWithContext(pending.ctx)
 	}
 }
 
+// enqueueWorker appends a worker to pendingQueue, and starts tracing its sync
+func (m *Manager) enqueueWorker(workerIdx int, name string) {
+	ctx, _ := tracing.Tracer().Start(context.Background(), "sync",
+		trace.WithAttributes(tracing.WorkerKey.String(name)))
+	_, queueWait := tracing.Tracer().Start(ctx, "queue_wait",
+		trace.WithAttributes(tracing.WorkerKey.String(name)))
+	m.pendingTraces[workerIdx] = pendingTrace{ctx: ctx, queueWait: queueWait}
+	m.pendingQueue = append(m.pendingQueue, workerIdx)
+}
+
 // Run will block current routine
 func (m *Manager) Run() {
 	m.logger.Debugf("%p", m)
@@ -223,6 +332,7 @@ func (m *Manager) Run() {
 			"event":         "call_runsync",
 			"target_worker": w.GetConfig()["name"],
 		}).Debugf("Calling RunSync() to w %s", w.GetConfig()["name"])
+		m.workersLastEnded[w.GetConfig()["name"].(string)] = w.GetStatus().LastEnded
 		go w.RunSync()
 	}
 	err := m.checkpoint()
@@ -232,6 +342,7 @@ func (m *Manager) Run() {
 			"error": err,
 		}).Error("Failed to checkpoint")
 	}
+	m.writeStatusPage()
 	for {
 		// wait until config.Interval seconds has elapsed
 		select {
@@ -240,6 +351,7 @@ func (m *Manager) Run() {
 				m.logger.WithField("event", "poll_start").Info("Start polling workers")
 				running_worker_cnt := 0
 				shouldCheckpoint := false
+				syncFinished := false
 				for i, w := range m.workers {
 					wStatus := w.GetStatus()
 					m.logger.WithFields(logrus.Fields{
@@ -249,32 +361,40 @@ func (m *Manager) Run() {
 						"target_worker_result":        wStatus.Result,
 						"target_worker_last_finished": wStatus.LastFinished,
 					})
+					wConfig := w.GetConfig()
+					wName := wConfig["name"].(string)
+					if !wStatus.LastEnded.Equal(m.workersLastEnded[wName]) {
+						m.workersLastEnded[wName] = wStatus.LastEnded
+						syncFinished = true
+					}
 					if !wStatus.Idle {
 						running_worker_cnt++
 						continue
 					}
-					wConfig := w.GetConfig()
-					elapsed := time.Since(m.workersLastInvokeTime[wConfig["name"].(string)])
-					sec2sync, ok := wConfig["interval"].(int)
-					if !ok {
-						sec2sync = 31536000 // if "interval" is not specified, then worker will launch once a year
-					}
+					refreshDiskUsage(wConfig)
+					elapsed := time.Since(m.workersLastInvokeTime[wName])
+					sec2sync := workerInterval(wConfig)
 					if !m.isAlreadyInPendingQueue(i) && elapsed > time.Duration(sec2sync)*time.Second {
 						m.logger.WithFields(logrus.Fields{
 							"event":                  "trigger_pending",
 							"target_worker_name":     wConfig["name"],
 							"target_worker_interval": sec2sync,
 						}).Infof("Interval of w %s (%d sec) elapsed, send it to pendingQueue", wConfig["name"], sec2sync)
-						m.pendingQueue = append(m.pendingQueue, i)
+						m.enqueueWorker(i, wName)
 						shouldCheckpoint = true
 					}
 				}
 				m.launchWorkerFromPendingQueue(m.config.ConcurrentLimit - running_worker_cnt)
+				exporter.GetInstance().SetPendingQueueLength(len(m.pendingQueue))
 				m.logger.WithField("event", "poll_end").Info("Stop polling workers")
+				if syncFinished {
+					m.writeStatusPage()
+				}
 
 				// Here we do not checkpoint very concisely (e.g. every time after a successful sync).
-				// We just want to minimize re-sync after restarting lug.
-				if shouldCheckpoint {
+				// We just want to minimize re-sync after restarting lug, and keep state of
+				// workers like serial of pypi worker, which is changed when a sync finishes.
+				if shouldCheckpoint || syncFinished {
 					err := m.checkpoint()
 					if err != nil {
 						m.logger.WithFields(logrus.Fields{
@@ -292,9 +412,11 @@ func (m *Manager) Run() {
 						Warningf("Unrecognized Control Signal: %d", sig)
 				case SigStart:
 					m.running = true
+					exporter.GetInstance().SetManagerRunning(true)
 					m.finishChan <- StartFinish
 				case SigStop:
 					m.running = false
+					exporter.GetInstance().SetManagerRunning(false)
 					m.finishChan <- StopFinish
 				case SigExit:
 					m.logger.WithField("event", "exit_control_signal").Info("Exiting...")
@@ -352,11 +474,52 @@ func (m *Manager) Exit() {
 	m.expectChanVal(m.finishChan, ExitFinish)
 }
 
+// RunContext is like Run, and also exits when ctx is done, e.g. on SIGTERM
+func (m *Manager) RunContext(ctx context.Context) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.logger.WithField("event", "exit_context_done").Info("Exiting on signal...")
+			m.Exit()
+		case <-done:
+		}
+	}()
+	m.Run()
+}
+
+// getLastInvokeTime returns when the worker was triggered last time, zero if never. It is safe to be called outside Run()
+func (m *Manager) getLastInvokeTime(name string) time.Time {
+	m.invokeTimeLock.RLock()
+	defer m.invokeTimeLock.RUnlock()
+	return m.workersLastInvokeTime[name]
+}
+
+// ErrWorkerNotFound is returned by Rollback if there is no worker of the name
+var ErrWorkerNotFound = errors.New("worker not found")
+
+// Rollback publishes the previous snapshot of a worker, and returns its name. It is safe to
+// be called outside Run()
+func (m *Manager) Rollback(name string) (string, error) {
+	for _, w := range m.workers {
+		if w.GetConfig()["name"] != name {
+			continue
+		}
+		if r, ok := w.(worker.Rollbacker); ok {
+			return r.Rollback()
+		}
+		return "", worker.ErrSnapshotDisabled
+	}
+	return "", ErrWorkerNotFound
+}
+
 // GetStatus gets status of Manager
 func (m *Manager) GetStatus() *Status {
 	status := Status{
-		Running:      m.running,
-		WorkerStatus: make(map[string]worker.Status),
+		Running:        m.running,
+		WorkerStatus:   make(map[string]worker.Status),
+		ListenerErrors: m.getListenerErrors(),
 	}
 	for _, w := range m.workers {
 		wConfig := w.GetConfig()
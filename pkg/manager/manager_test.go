@@ -1,7 +1,17 @@
 package manager
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -9,12 +19,14 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/worker"
 )
 
 func TestManagerStartUp(t *testing.T) {
 	manager, err := NewManager(&config.Config{
-		Interval: 3,
-		Repos:    []config.RepoConfig{},
+		Interval:   3,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json"),
+		Repos:      []config.RepoConfig{},
 	})
 	assert.Nil(t, err)
 	if assert.NotNil(t, manager) {
@@ -34,3 +46,305 @@ func TestManagerStartUp(t *testing.T) {
 		assert.False(t, status.Running)
 	}
 }
+
+func TestManagerRunContext(t *testing.T) {
+	manager, err := NewManager(&config.Config{
+		Interval:   3,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json"),
+		Repos:      []config.RepoConfig{},
+	})
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan struct{})
+	go func() {
+		manager.RunContext(ctx)
+		close(exited)
+	}()
+	// cancelling ctx, like a signal does, makes RunContext return
+	cancel()
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "manager did not exit")
+	}
+	assert.False(t, manager.GetStatus().Running)
+}
+
+func TestManagerServeReportsListenerError(t *testing.T) {
+	asrt := assert.New(t)
+	manager, err := NewManager(&config.Config{
+		Interval: 3,
+		Repos:    []config.RepoConfig{},
+	})
+	asrt.Nil(err)
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	asrt.Nil(err)
+	defer occupied.Close()
+
+	// a port clash should not kill the process
+	reloader := manager.Serve("exporter", config.ListenerConfig{Address: occupied.Addr().String()}, http.NotFoundHandler())
+	asrt.Nil(reloader)
+	status := manager.GetStatus()
+	asrt.Contains(status.ListenerErrors, "exporter")
+	asrt.Contains(status.ListenerErrors["exporter"], "address already in use")
+}
+
+func TestRestfulAPIProbes(t *testing.T) {
+	asrt := assert.New(t)
+	manager, err := NewManager(&config.Config{
+		Interval:   3,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json"),
+		Repos:      []config.RepoConfig{},
+	})
+	asrt.Nil(err)
+	server := httptest.NewServer(NewRestfulAPI(manager).GetAPIHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/healthz")
+	asrt.Nil(err)
+	asrt.Equal(http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	readyz := func() (int, ReadyStatus) {
+		var ready ReadyStatus
+		resp, err := http.Get(server.URL + "/readyz")
+		if !asrt.Nil(err) {
+			return 0, ready
+		}
+		defer resp.Body.Close()
+		asrt.Nil(json.NewDecoder(resp.Body).Decode(&ready))
+		return resp.StatusCode, ready
+	}
+	code, ready := readyz()
+	asrt.Equal(http.StatusOK, code)
+	asrt.True(ready.Ready)
+
+	manager.config.Checkpoint = "/nonexistent/checkpoint.json"
+	code, ready = readyz()
+	asrt.Equal(http.StatusServiceUnavailable, code)
+	asrt.False(ready.Ready)
+	asrt.Len(ready.Reasons, 1)
+}
+
+func TestMirrorzStatus(t *testing.T) {
+	asrt := assert.New(t)
+	invoke := time.Unix(1624540800, 0)
+	finished := time.Unix(1624454400, 0)
+	cfg := config.RepoConfig{"type": "shell_script", "interval": 3600}
+	asrt.Equal("S1624454400X1624544400", mirrorzStatus(cfg, worker.Status{Idle: true, Result: true, LastFinished: finished}, invoke))
+	asrt.Equal("Y1624540800O1624454400X1624544400", mirrorzStatus(cfg, worker.Status{Idle: false, Result: true, LastFinished: finished}, invoke))
+	// the failure is timestamped when the run ended rather than when it was invoked
+	failed := invoke.Add(time.Minute)
+	asrt.Equal("F1624540860O1624454400X1624544400", mirrorzStatus(cfg, worker.Status{Idle: true, Result: false, LastFinished: finished, LastEnded: failed}, invoke))
+	external := config.RepoConfig{"type": "external"}
+	asrt.Equal("C", mirrorzStatus(external, worker.Status{Idle: true, Result: true}, invoke))
+	asrt.Equal("C1624454400", mirrorzStatus(external, worker.Status{Idle: true, Result: true, LastFinished: finished}, invoke))
+	// the freshness probe of external worker fails
+	asrt.Equal("FO1624454400", mirrorzStatus(external, worker.Status{Idle: true, Result: false, LastFinished: finished}, invoke))
+	// never invoked, so it is due now
+	status := mirrorzStatus(cfg, worker.Status{Idle: false, Result: true}, time.Time{})
+	asrt.Regexp(`^YX[0-9]+$`, status)
+	next, err := strconv.ParseInt(strings.TrimPrefix(status, "YX"), 10, 64)
+	asrt.Nil(err)
+	asrt.InDelta(time.Now().Unix(), next, 5)
+	delete(cfg, "interval")
+	asrt.Equal("S1624454400", mirrorzStatus(cfg, worker.Status{Idle: true, Result: true, LastFinished: finished}, invoke))
+}
+
+func TestGetMirrorz(t *testing.T) {
+	asrt := assert.New(t)
+	manager, err := NewManager(&config.Config{
+		Interval: 3,
+		MirrorzConfig: config.MirrorzConfig{
+			Site: config.MirrorzSiteConfig{Abbr: "SJTUG", URL: "https://mirror.sjtu.edu.cn"},
+		},
+		Repos: []config.RepoConfig{
+			{"type": "external", "name": "ubuntu", "description": "Ubuntu", "upstream": "http://ftp.sjtu.edu.cn/ubuntu/"},
+			{"type": "shell_script", "name": "putty", "script": "true", "url": "/putty-website", "help": "/docs/putty"},
+			{"type": "external", "name": "secret", "hidden": true},
+		},
+	})
+	asrt.Nil(err)
+	mirrorz := manager.GetMirrorz()
+	asrt.Equal("SJTUG", mirrorz.Site.Abbr)
+	if asrt.Len(mirrorz.Mirrors, 2) {
+		asrt.Equal(MirrorzMirror{
+			Cname:  "putty",
+			URL:    "/putty-website",
+			Help:   "/docs/putty",
+			Status: mirrorz.Mirrors[0].Status,
+		}, mirrorz.Mirrors[0])
+		// never synced, so there is no timestamp
+		asrt.Equal("S", mirrorz.Mirrors[0].Status)
+		asrt.Equal(MirrorzMirror{
+			Cname:    "ubuntu",
+			Desc:     "Ubuntu",
+			URL:      "/ubuntu",
+			Status:   "C",
+			Upstream: "http://ftp.sjtu.edu.cn/ubuntu/",
+		}, mirrorz.Mirrors[1])
+	}
+}
+
+func TestTunasyncJobs(t *testing.T) {
+	asrt := assert.New(t)
+	cfg := &config.Config{
+		Interval: 3,
+		Repos: []config.RepoConfig{
+			{"type": "shell_script", "name": "putty", "script": "true", "interval": 600, "upstream": "rsync://example.com/putty/"},
+			{"type": "external", "name": "secret", "hidden": true},
+		},
+	}
+	manager, err := NewManager(cfg)
+	asrt.Nil(err)
+
+	// disabled by default
+	server := httptest.NewServer(NewRestfulAPI(manager).GetAPIHandler())
+	resp, err := http.Get(server.URL + "/jobs")
+	asrt.Nil(err)
+	asrt.Equal(http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+	server.Close()
+
+	cfg.JsonAPIConfig.Tunasync = true
+	server = httptest.NewServer(NewRestfulAPI(manager).GetAPIHandler())
+	defer server.Close()
+	resp, err = http.Get(server.URL + "/jobs")
+	asrt.Nil(err)
+	defer resp.Body.Close()
+	var jobs []map[string]interface{}
+	asrt.Nil(json.NewDecoder(resp.Body).Decode(&jobs))
+	if asrt.Len(jobs, 1) {
+		job := jobs[0]
+		asrt.Equal("putty", job["name"])
+		asrt.Equal("success", job["status"])
+		asrt.Equal(true, job["is_master"])
+		asrt.Equal("rsync://example.com/putty/", job["upstream"])
+		asrt.Equal("unknown", job["size"])
+		// never invoked, so it is due now
+		asrt.EqualValues(0, job["last_started_ts"])
+		asrt.Equal("", job["last_started"])
+		asrt.InDelta(time.Now().Unix(), job["next_schedule_ts"], 5)
+	}
+
+	lastStarted := time.Now().Add(-time.Minute)
+	job := newTunasyncJob(true, cfg.Repos[0], worker.Status{Idle: true, Result: true}, lastStarted)
+	content, err := json.Marshal(job)
+	asrt.Nil(err)
+	var marshaled map[string]interface{}
+	asrt.Nil(json.Unmarshal(content, &marshaled))
+	asrt.EqualValues(lastStarted.Unix(), marshaled["last_started_ts"])
+	asrt.EqualValues(lastStarted.Add(600*time.Second).Unix(), marshaled["next_schedule_ts"])
+	asrt.Equal(lastStarted.Format(tunasyncTimeLayout), marshaled["last_started"])
+}
+
+func TestStatusPage(t *testing.T) {
+	asrt := assert.New(t)
+	dir := t.TempDir()
+	cfg := &config.Config{
+		Interval: 3,
+		Repos: []config.RepoConfig{
+			{"type": "shell_script", "name": "putty", "script": "true"},
+			{"type": "external", "name": "ubuntu", "url": "http://ftp.sjtu.edu.cn/ubuntu/"},
+			{"type": "external", "name": "secret", "hidden": true},
+		},
+	}
+	manager, err := NewManager(cfg)
+	asrt.Nil(err)
+	server := httptest.NewServer(NewRestfulAPI(manager).GetAPIHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/status.html")
+	asrt.Nil(err)
+	asrt.Equal(http.StatusOK, resp.StatusCode)
+	asrt.Contains(resp.Header.Get("Content-Type"), "text/html")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	asrt.Nil(err)
+	asrt.Contains(string(body), `<a href="/putty">putty</a>`)
+	asrt.Contains(string(body), `<a href="http://ftp.sjtu.edu.cn/ubuntu/">ubuntu</a>`)
+	asrt.Contains(string(body), `<td class="cached">cached</td>`)
+	// workers never invoked have no last attempt
+	asrt.Contains(string(body), `<td>never</td>`)
+	asrt.NotContains(string(body), "secret")
+
+	// custom template and output file
+	template := filepath.Join(dir, "status.tmpl")
+	asrt.Nil(os.WriteFile(template, []byte(`{{range .Repos}}{{.Name}}={{.State}};{{end}}`), 0644))
+	cfg.StatusPageConfig = config.StatusPageConfig{
+		Template: template,
+		Output:   filepath.Join(dir, "index.html"),
+	}
+	manager, err = NewManager(cfg)
+	asrt.Nil(err)
+	manager.writeStatusPage()
+	content, err := os.ReadFile(cfg.StatusPageConfig.Output)
+	asrt.Nil(err)
+	asrt.Equal("putty=success;ubuntu=cached;", string(content))
+
+	asrt.Nil(os.WriteFile(template, []byte(`{{range .Repos}`), 0644))
+	_, err = NewManager(cfg)
+	asrt.Error(err)
+
+	// external worker whose freshness probe fails is not cached
+	manager, err = NewManager(&config.Config{
+		Interval: 3,
+		Repos: []config.RepoConfig{
+			{"type": "external", "name": "dead", "freshness_file": filepath.Join(dir, "nonexistent")},
+		},
+	})
+	asrt.Nil(err)
+	asrt.Eventually(func() bool {
+		return manager.getStatusPageData().Repos[0].State == "failed"
+	}, 5*time.Second, 10*time.Millisecond)
+	asrt.Equal("F", manager.GetMirrorz().Mirrors[0].Status)
+}
+
+func TestCheckpointWorkerState(t *testing.T) {
+	asrt := assert.New(t)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	asrt.Nil(os.WriteFile(checkpoint, []byte(`{"worker_info": {"pypi": {
+		"last_invoke_time": "2024-01-01T00:00:00Z", "state": {"serial": "42"}}}}`), 0644))
+	manager, err := NewManager(&config.Config{
+		Interval:   3,
+		Checkpoint: checkpoint,
+		Repos: []config.RepoConfig{
+			{"type": "pypi", "name": "pypi", "path": t.TempDir()},
+			{"type": "shell_script", "name": "shell", "script": "true"},
+		},
+	})
+	asrt.Nil(err)
+	asrt.Equal(map[string]string{"serial": "42"}, manager.workers[0].(worker.Checkpointer).CheckpointState())
+
+	asrt.Nil(manager.checkpoint())
+	restored, err := fromCheckpoint(checkpoint)
+	asrt.Nil(err)
+	asrt.Equal(map[string]string{"serial": "42"}, restored.WorkerInfo["pypi"].State)
+	asrt.Nil(restored.WorkerInfo["shell"].State)
+}
+
+func TestRestfulAPIRollback(t *testing.T) {
+	asrt := assert.New(t)
+	manager, err := NewManager(&config.Config{
+		Interval:   3,
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json"),
+		Repos: []config.RepoConfig{
+			{"type": "shell_script", "name": "snapshot", "script": "true", "path": t.TempDir(), "snapshot": true},
+			{"type": "shell_script", "name": "plain", "script": "true"},
+		},
+	})
+	asrt.Nil(err)
+	server := httptest.NewServer(NewRestfulAPI(manager).GetAPIHandler())
+	defer server.Close()
+
+	for name, code := range map[string]int{
+		"missing":  http.StatusNotFound,
+		"plain":    http.StatusBadRequest,
+		"snapshot": http.StatusConflict,
+	} {
+		resp, err := http.Post(server.URL+"/lug/v1/admin/worker/"+name+"/rollback", "application/json", nil)
+		if asrt.Nil(err) {
+			asrt.Equal(code, resp.StatusCode, name)
+			resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/worker"
+)
+
+// mirrorzVersion is the version of mirrorz format we generate
+const mirrorzVersion = 1.7
+
+// MirrorzMirror is a mirror entry in mirrorz format
+type MirrorzMirror struct {
+	Cname    string `json:"cname"`
+	Desc     string `json:"desc"`
+	URL      string `json:"url"`
+	Status   string `json:"status"`
+	Help     string `json:"help"`
+	Upstream string `json:"upstream"`
+	Size     string `json:"size"`
+}
+
+// Mirrorz is the status of all mirrors in mirrorz format
+type Mirrorz struct {
+	Version float64                  `json:"version"`
+	Site    config.MirrorzSiteConfig `json:"site"`
+	Info    []interface{}            `json:"info"`
+	Mirrors []MirrorzMirror          `json:"mirrors"`
+}
+
+// appendTimestamp appends a flag and its unix timestamp to mirrorz status, or nothing if t is zero
+func appendTimestamp(status string, flag string, t time.Time) string {
+	if t.IsZero() {
+		return status
+	}
+	return fmt.Sprintf("%s%s%d", status, flag, t.Unix())
+}
+
+// mirrorzStatus converts worker status into mirrorz status string, e.g. S1624540800X1624627200.
+// lastInvokeTime is zero if the worker has never been invoked
+func mirrorzStatus(cfg config.RepoConfig, status worker.Status, lastInvokeTime time.Time) string {
+	if cfg["type"] == "external" {
+		// LastFinished of external worker is when its freshness probe last succeeded
+		if !status.Result {
+			return appendTimestamp("F", "O", status.LastFinished)
+		}
+		return appendTimestamp("C", "", status.LastFinished)
+	}
+	var result string
+	switch {
+	case !status.Idle:
+		result = appendTimestamp("Y", "", lastInvokeTime)
+		result = appendTimestamp(result, "O", status.LastFinished)
+	case status.Result:
+		result = appendTimestamp("S", "", status.LastFinished)
+	default:
+		result = appendTimestamp("F", "", status.LastEnded)
+		result = appendTimestamp(result, "O", status.LastFinished)
+	}
+	if interval, ok := cfg["interval"].(int); ok {
+		result = appendTimestamp(result, "X", nextInvokeTime(lastInvokeTime, interval))
+	}
+	return result
+}
+
+// GetMirrorz returns status of non-hidden workers in mirrorz format
+func (m *Manager) GetMirrorz() *Mirrorz {
+	result := Mirrorz{
+		Version: mirrorzVersion,
+		Site:    m.config.MirrorzConfig.Site,
+		Info:    []interface{}{},
+		Mirrors: []MirrorzMirror{},
+	}
+	for _, w := range m.workers {
+		wConfig := w.GetConfig()
+		if hidden, ok := wConfig["hidden"].(bool); ok && hidden {
+			continue
+		}
+		name := wConfig["name"].(string)
+		url, ok := wConfig["url"].(string)
+		if !ok {
+			url = "/" + name
+		}
+		desc, _ := wConfig["description"].(string)
+		help, _ := wConfig["help"].(string)
+		upstream, _ := wConfig["upstream"].(string)
+		wStatus := w.GetStatus()
+		var size string
+		if wStatus.DiskUsage > 0 {
+			size = formatSize(wStatus.DiskUsage)
+		}
+		result.Mirrors = append(result.Mirrors, MirrorzMirror{
+			Cname:    name,
+			Desc:     desc,
+			URL:      url,
+			Status:   mirrorzStatus(wConfig, wStatus, m.getLastInvokeTime(name)),
+			Help:     help,
+			Upstream: upstream,
+			Size:     size,
+		})
+	}
+	sort.Slice(result.Mirrors, func(i, j int) bool {
+		return result.Mirrors[i].Cname < result.Mirrors[j].Cname
+	})
+	return &result
+}
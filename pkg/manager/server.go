@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/helper"
+)
+
+// Serve listens as described by listenerCfg and serves handler in background.
+// Failures of the listener (e.g. address already in use) are logged and recorded
+// in Status.ListenerErrors instead of terminating lug. The returned CertReloader
+// is nil if TLS is disabled or listening fails.
+func (m *Manager) Serve(name string, listenerCfg config.ListenerConfig, handler http.Handler) *helper.CertReloader {
+	l, reloader, err := helper.Listen(listenerCfg)
+	if err != nil {
+		m.reportListenerError(name, err)
+		return nil
+	}
+	m.logger.WithFields(logrus.Fields{
+		"event":    "listener_started",
+		"listener": name,
+		"address":  listenerCfg.Address,
+		"tls":      reloader != nil,
+	}).Infof("Listener %s serving at %s", name, listenerCfg.Address)
+	go func() {
+		m.reportListenerError(name, http.Serve(l, handler))
+	}()
+	return reloader
+}
+
+func (m *Manager) reportListenerError(name string, err error) {
+	m.logger.WithFields(logrus.Fields{
+		"event":    "listener_failed",
+		"listener": name,
+		"error":    err,
+	}).Errorf("Listener %s failed", name)
+	m.listenerLock.Lock()
+	defer m.listenerLock.Unlock()
+	m.listenerErrors[name] = err.Error()
+}
+
+func (m *Manager) getListenerErrors() map[string]string {
+	m.listenerLock.Lock()
+	defer m.listenerLock.Unlock()
+	result := make(map[string]string, len(m.listenerErrors))
+	for k, v := range m.listenerErrors {
+		result[k] = v
+	}
+	return result
+}
+
+// checkCheckpointWritable returns nil if the checkpoint could be written
+func (m *Manager) checkCheckpointWritable() error {
+	if m.config.Checkpoint == "" {
+		return nil
+	}
+	// checkpoint() writes a temporary file and renames it, so the directory must be writable
+	if err := unix.Access(filepath.Dir(m.config.Checkpoint), unix.W_OK); err != nil {
+		return errors.New("checkpoint directory is not writable: " + err.Error())
+	}
+	if err := unix.Access(m.config.Checkpoint, unix.W_OK); err != nil && !os.IsNotExist(err) {
+		return errors.New("checkpoint is not writable: " + err.Error())
+	}
+	return nil
+}
+
+// NotReadyReasons returns why the manager is not ready to serve, or an empty slice if it is ready
+func (m *Manager) NotReadyReasons() []string {
+	reasons := []string{}
+	if !m.running {
+		reasons = append(reasons, "manager is not running")
+	}
+	if err := m.checkCheckpointWritable(); err != nil {
+		reasons = append(reasons, err.Error())
+	}
+	return reasons
+}
@@ -0,0 +1,179 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// defaultStatusPageTemplate is used when status_page.template is not set
+const defaultStatusPageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Mirror Status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 1em; border-bottom: 1px solid #ddd; text-align: left; }
+.success { color: #2a2; } .syncing { color: #26c; } .failed { color: #c22; } .cached { color: #888; }
+</style>
+</head>
+<body>
+<h1>Mirror Status</h1>
+<table>
+<tr><th>Name</th><th>State</th><th>Last Success</th><th>Last Attempt</th><th>Size</th></tr>
+{{- range .Repos}}
+<tr>
+<td><a href="{{.URL}}">{{.Name}}</a></td>
+<td class="{{.State}}">{{.State}}</td>
+<td>{{formatTime .LastSuccess}}</td>
+<td>{{if .LastAttempt.IsZero}}never{{else}}{{formatTime .LastAttempt}}{{end}}</td>
+<td>{{.Size}}</td>
+</tr>
+{{- end}}
+</table>
+<p>Generated at {{formatTime .GeneratedAt}}{{if not .Running}}, synchronization is paused{{end}}</p>
+</body>
+</html>
+`
+
+// StatusPageRepo is the status of a repo rendered in status page
+type StatusPageRepo struct {
+	Name string
+	// State is one of success, syncing, failed and cached
+	State       string
+	LastSuccess time.Time
+	// LastAttempt is zero if the repo has never been invoked
+	LastAttempt time.Time
+	Size        string
+	URL         string
+}
+
+// StatusPageData is passed to the template of status page
+type StatusPageData struct {
+	GeneratedAt time.Time
+	Running     bool
+	Repos       []StatusPageRepo
+}
+
+var statusPageFuncs = template.FuncMap{
+	"formatTime": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04:05 -0700")
+	},
+}
+
+// newStatusPageTemplate parses the template configured, or the built-in one if not configured
+func newStatusPageTemplate(cfg config.StatusPageConfig) (*template.Template, error) {
+	text := defaultStatusPageTemplate
+	if cfg.Template != "" {
+		content, err := os.ReadFile(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+	tmpl, err := template.New("status_page").Funcs(statusPageFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid status page template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// getStatusPageData collects status of non-hidden workers for status page
+func (m *Manager) getStatusPageData() StatusPageData {
+	data := StatusPageData{
+		GeneratedAt: time.Now(),
+		Running:     m.running,
+		Repos:       []StatusPageRepo{},
+	}
+	for _, w := range m.workers {
+		wConfig := w.GetConfig()
+		if hidden, ok := wConfig["hidden"].(bool); ok && hidden {
+			continue
+		}
+		name := wConfig["name"].(string)
+		wStatus := w.GetStatus()
+		url, ok := wConfig["url"].(string)
+		if !ok {
+			url = "/" + name
+		}
+		repo := StatusPageRepo{
+			Name:        name,
+			LastSuccess: wStatus.LastFinished,
+			LastAttempt: m.getLastInvokeTime(name),
+			Size:        formatSize(wStatus.DiskUsage),
+			URL:         url,
+		}
+		switch {
+		case wConfig["type"] == "external" && wStatus.Result:
+			repo.State = "cached"
+		case !wStatus.Idle:
+			repo.State = "syncing"
+		case wStatus.Result:
+			repo.State = "success"
+		default:
+			repo.State = "failed"
+		}
+		data.Repos = append(data.Repos, repo)
+	}
+	sort.Slice(data.Repos, func(i, j int) bool {
+		return data.Repos[i].Name < data.Repos[j].Name
+	})
+	return data
+}
+
+// RenderStatusPage renders HTML status page into a buffer
+func (m *Manager) RenderStatusPage() (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	if err := m.statusPage.Execute(&buf, m.getStatusPageData()); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// writeStatusPage renders status page into the configured output file atomically
+func (m *Manager) writeStatusPage() {
+	output := m.config.StatusPageConfig.Output
+	if output == "" {
+		return
+	}
+	buf, err := m.RenderStatusPage()
+	if err == nil {
+		tmp := output + ".tmp"
+		err = os.WriteFile(tmp, buf.Bytes(), 0644)
+		if err == nil {
+			err = os.Rename(tmp, output)
+		}
+	}
+	if err != nil {
+		m.logger.WithFields(logrus.Fields{
+			"event": "write_status_page_failed",
+			"error": err,
+		}).Error("Failed to write status page")
+	}
+}
+
+// StatusPageHandler serves the HTML status page
+func (m *Manager) StatusPageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf, err := m.RenderStatusPage()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		buf.WriteTo(w)
+	})
+}
@@ -0,0 +1,109 @@
+package manager
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/worker"
+)
+
+// tunasyncTimeLayout is the layout of human-readable time in tunasync
+const tunasyncTimeLayout = "2006-01-02 15:04:05 -0700"
+
+// tunasyncTextTime is marshaled in tunasyncTimeLayout, or as an empty string if zero
+type tunasyncTextTime struct {
+	time.Time
+}
+
+func (t tunasyncTextTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return json.Marshal("")
+	}
+	return json.Marshal(t.Format(tunasyncTimeLayout))
+}
+
+// tunasyncStampTime is marshaled as unix timestamp, or 0 if zero
+type tunasyncStampTime struct {
+	time.Time
+}
+
+func (t tunasyncStampTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return json.Marshal(0)
+	}
+	return json.Marshal(t.Unix())
+}
+
+// TunasyncJob is the status of a worker in the schema of tunasync /jobs
+type TunasyncJob struct {
+	Name          string            `json:"name"`
+	IsMaster      bool              `json:"is_master"`
+	Status        string            `json:"status"`
+	LastUpdate    tunasyncTextTime  `json:"last_update"`
+	LastUpdateTs  tunasyncStampTime `json:"last_update_ts"`
+	LastStarted   tunasyncTextTime  `json:"last_started"`
+	LastStartedTs tunasyncStampTime `json:"last_started_ts"`
+	LastEnded     tunasyncTextTime  `json:"last_ended"`
+	LastEndedTs   tunasyncStampTime `json:"last_ended_ts"`
+	Scheduled     tunasyncTextTime  `json:"next_schedule"`
+	ScheduledTs   tunasyncStampTime `json:"next_schedule_ts"`
+	Upstream      string            `json:"upstream"`
+	Size          string            `json:"size"`
+}
+
+// tunasyncStatus converts worker status into one of the sync status of tunasync
+func tunasyncStatus(managerRunning bool, status worker.Status) string {
+	switch {
+	case !status.Idle:
+		return "syncing"
+	case !managerRunning:
+		return "paused"
+	case status.Result:
+		return "success"
+	default:
+		return "failed"
+	}
+}
+
+// newTunasyncJob creates a tunasync job from status and config of a worker
+func newTunasyncJob(managerRunning bool, cfg config.RepoConfig, status worker.Status, lastInvokeTime time.Time) TunasyncJob {
+	upstream, _ := cfg["upstream"].(string)
+	var nextSchedule time.Time
+	if interval, ok := cfg["interval"].(int); ok {
+		nextSchedule = nextInvokeTime(lastInvokeTime, interval)
+	}
+	return TunasyncJob{
+		Name:          cfg["name"].(string),
+		IsMaster:      true,
+		Status:        tunasyncStatus(managerRunning, status),
+		LastUpdate:    tunasyncTextTime{status.LastFinished},
+		LastUpdateTs:  tunasyncStampTime{status.LastFinished},
+		LastStarted:   tunasyncTextTime{lastInvokeTime},
+		LastStartedTs: tunasyncStampTime{lastInvokeTime},
+		LastEnded:     tunasyncTextTime{status.LastEnded},
+		LastEndedTs:   tunasyncStampTime{status.LastEnded},
+		Scheduled:     tunasyncTextTime{nextSchedule},
+		ScheduledTs:   tunasyncStampTime{nextSchedule},
+		Upstream:      upstream,
+		Size:          formatSize(status.DiskUsage),
+	}
+}
+
+// GetTunasyncJobs returns status of non-hidden workers in the schema of tunasync /jobs
+func (m *Manager) GetTunasyncJobs() []TunasyncJob {
+	result := []TunasyncJob{}
+	for _, w := range m.workers {
+		wConfig := w.GetConfig()
+		if hidden, ok := wConfig["hidden"].(bool); ok && hidden {
+			continue
+		}
+		name := wConfig["name"].(string)
+		result = append(result, newTunasyncJob(m.running, wConfig, w.GetStatus(), m.getLastInvokeTime(name)))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
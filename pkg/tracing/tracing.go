@@ -0,0 +1,64 @@
+// Package tracing provides OpenTelemetry tracing of synchronizations
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// instrumentationName identifies spans created by lug
+const instrumentationName = "github.com/sjtug/lug"
+
+// WorkerKey is the attribute of worker name on spans
+const WorkerKey = attribute.Key("lug.worker")
+
+// Tracer returns the tracer of lug. Spans are dropped unless Setup is called
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup installs a global tracer provider exporting spans to cfg.Endpoint via OTLP/HTTP.
+// The returned function flushes pending spans and should be called before exit
+func Setup(cfg config.TracingConfig) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Environ returns environment variables carrying the span in ctx in W3C trace context format,
+// e.g. TRACEPARENT=00-...-01, so that scripts could add child spans. It is empty without a span
+func Environ(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	var env []string
+	if traceparent := carrier.Get("traceparent"); traceparent != "" {
+		env = append(env, "TRACEPARENT="+traceparent)
+	}
+	if tracestate := carrier.Get("tracestate"); tracestate != "" {
+		env = append(env, "TRACESTATE="+tracestate)
+	}
+	return env
+}
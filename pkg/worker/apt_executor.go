@@ -0,0 +1,504 @@
+package worker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
+)
+
+// aptStagingDir is where indexes are downloaded before they are published
+const aptStagingDir = ".lug-apt"
+
+// aptReleaseFiles are files of a suite fetched before indexes, and published last. InRelease
+// is published at the very last since it is preferred by clients
+var aptReleaseFiles = []string{"Release", "Release.gpg", "InRelease"}
+
+// aptIndexNames are indexes of a component that are mirrored, in order of preference for parsing
+var aptIndexNames = map[string][]string{
+	"binary": {"Packages", "Packages.gz", "Packages.xz", "Release"},
+	"source": {"Sources", "Sources.gz", "Sources.xz", "Release"},
+}
+
+// aptExecutor implements executor interface by mirroring suites of a Debian archive. Only
+// pool files referenced by selected indexes are downloaded, and indexes are published after
+// all of them are verified, so that clients never see indexes referencing missing files
+type aptExecutor struct {
+	source        *url.URL
+	path          string
+	suites        []string
+	components    []string
+	architectures []string
+	// sources mirrors source packages as well
+	sources     bool
+	concurrency int
+	// gc removes pool files which are not referenced by any index
+	gc     bool
+	client *http.Client
+}
+
+func newAptExecutor(cfg config.RepoConfig) (*aptExecutor, error) {
+	options := map[string]string{}
+	for _, key := range []string{"source", "path", "suites", "components", "architectures"} {
+		value, err := stringOption(cfg, key)
+		if err != nil {
+			return nil, err
+		}
+		options[key] = value
+	}
+	if options["source"] == "" || options["path"] == "" || options["suites"] == "" {
+		return nil, errors.New("source, path and suites are required by apt worker")
+	}
+	sourceURL, err := url.Parse(options["source"])
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		return nil, errors.New("source should be an http or https URL")
+	}
+	if !strings.HasSuffix(sourceURL.Path, "/") {
+		sourceURL.Path += "/"
+	}
+	a := &aptExecutor{
+		source:        sourceURL,
+		path:          options["path"],
+		suites:        strings.Fields(options["suites"]),
+		components:    strings.Fields(options["components"]),
+		architectures: strings.Fields(options["architectures"]),
+		concurrency:   defaultConcurrency,
+		gc:            true,
+		client:        newHTTPClient(),
+	}
+	if len(a.components) == 0 {
+		a.components = []string{"main"}
+	}
+	if len(a.architectures) == 0 {
+		a.architectures = []string{"amd64"}
+	}
+	if sources, ok := cfg["sources"]; ok {
+		if a.sources, ok = sources.(bool); !ok {
+			return nil, errors.New("sources should be a boolean when present")
+		}
+	}
+	if gc, ok := cfg["gc"]; ok {
+		if a.gc, ok = gc.(bool); !ok {
+			return nil, errors.New("gc should be a boolean when present")
+		}
+	}
+	if concurrency, ok := cfg["concurrency"]; ok {
+		if a.concurrency, ok = concurrency.(int); !ok || a.concurrency <= 0 {
+			return nil, errors.New("concurrency should be a positive integer when present")
+		}
+	}
+	return a, nil
+}
+
+// aptRun is the state of a sync of apt worker
+type aptRun struct {
+	ctx context.Context
+	// path is the archive synced in this run, see targetPath
+	path     string
+	staging  string
+	stdout   strings.Builder
+	stderr   strings.Builder
+	transfer exporter.TransferStats
+	// staged are files in staging to be published, relative to path
+	staged []string
+	// releases are staged Release files, published after other files
+	releases []string
+	// pool are files referenced by indexes, by path relative to path
+	pool  map[string]remoteFile
+	mutex sync.Mutex
+}
+
+// fetch downloads files into dir in parallel, and returns how many failed. Files not found
+// are skipped if optional
+func (a *aptExecutor) fetch(r *aptRun, dir string, files []remoteFile, optional bool) (fetched map[string]bool, failed int) {
+	fetched = map[string]bool{}
+	forEachParallel(len(files), a.concurrency, func(i int) {
+		f := files[i]
+		result, err := fetch(r.ctx, a.client, download{
+			url:    f.url,
+			dest:   filepath.Join(dir, filepath.FromSlash(f.path)),
+			size:   f.size,
+			sha256: f.sha256,
+		})
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.transfer.BytesReceived += result.bytes
+		if optional && errors.Is(err, errNotFound) {
+			return
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(&r.stderr, "%s: %v\n", f.path, err)
+			return
+		}
+		fetched[f.path] = true
+		r.transfer.FilesTransferred++
+		fmt.Fprintf(&r.stdout, "downloaded %s\n", f.path)
+	})
+	return fetched, failed
+}
+
+// remote describes the file at rel of source
+func (a *aptExecutor) remote(rel string, size int64, sum string) remoteFile {
+	return remoteFile{path: rel, url: a.source.ResolveReference(&url.URL{Path: rel}).String(), size: size, sha256: sum}
+}
+
+// fetchRelease stages Release files of suite, and returns SHA256 entries of the release
+func (a *aptExecutor) fetchRelease(r *aptRun, suite string) (map[string]remoteFile, error) {
+	var content []byte
+	for _, name := range aptReleaseFiles {
+		f := a.remote(path.Join("dists", suite, name), -1, "")
+		_, err := fetch(r.ctx, a.client, download{url: f.url, dest: filepath.Join(r.staging, filepath.FromSlash(f.path)), size: f.size})
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.releases = append(r.releases, f.path)
+		if name != "Release.gpg" {
+			// signatures are not verified, which is left to clients
+			if content, err = os.ReadFile(filepath.Join(r.staging, filepath.FromSlash(f.path))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if content == nil {
+		return nil, fmt.Errorf("neither Release nor InRelease found in suite %s", suite)
+	}
+	entries := map[string]remoteFile{}
+	err := parseControl(strings.NewReader(clearsigned(string(content))), func(fields map[string]string) error {
+		for _, line := range strings.Split(fields["SHA256"], "\n") {
+			parts := strings.Fields(line)
+			if len(parts) != 3 {
+				continue
+			}
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid size in Release of suite %s: %q", suite, line)
+			}
+			entries[parts[2]] = a.remote(path.Join("dists", suite, parts[2]), size, parts[0])
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// selectIndexes returns indexes of selected components and architectures, grouped by directory
+func (a *aptExecutor) selectIndexes(entries map[string]remoteFile) map[string][]remoteFile {
+	selected := map[string][]remoteFile{}
+	for _, component := range a.components {
+		dirs := map[string][]string{}
+		for _, arch := range a.architectures {
+			dirs[component+"/binary-"+arch] = aptIndexNames["binary"]
+		}
+		if a.sources {
+			dirs[component+"/source"] = aptIndexNames["source"]
+		}
+		for dir, names := range dirs {
+			for _, name := range names {
+				if f, ok := entries[dir+"/"+name]; ok {
+					selected[dir] = append(selected[dir], f)
+				}
+			}
+		}
+	}
+	return selected
+}
+
+// stageIndexes downloads indexes into staging, linking published ones if they are unchanged.
+// Indexes listed in Release may be absent, e.g. uncompressed Packages of Debian, so it
+// returns the staged ones in the original order
+func (a *aptExecutor) stageIndexes(r *aptRun, indexes []remoteFile) ([]remoteFile, error) {
+	linked := map[string]bool{}
+	var missing []remoteFile
+	for _, f := range indexes {
+		published := filepath.Join(r.path, filepath.FromSlash(f.path))
+		staged := filepath.Join(r.staging, filepath.FromSlash(f.path))
+		if verify(published, f.size, f.sha256) == nil {
+			if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+				return nil, err
+			}
+			if err := os.Link(published, staged); err == nil {
+				linked[f.path] = true
+				continue
+			}
+		}
+		missing = append(missing, f)
+	}
+	fetched, failed := a.fetch(r, r.staging, missing, true)
+	if failed > 0 {
+		return nil, fmt.Errorf("%d of %d indexes failed", failed, len(missing))
+	}
+	var staged []remoteFile
+	for _, f := range indexes {
+		if linked[f.path] || fetched[f.path] {
+			staged = append(staged, f)
+			r.staged = append(r.staged, f.path)
+		}
+	}
+	return staged, nil
+}
+
+// parseIndex adds files referenced by the first parseable index to pool
+func (a *aptExecutor) parseIndex(r *aptRun, indexes []remoteFile) error {
+	for _, f := range indexes {
+		name := path.Base(f.path)
+		if !strings.HasPrefix(name, "Packages") && !strings.HasPrefix(name, "Sources") || strings.HasSuffix(name, ".xz") {
+			continue
+		}
+		file, err := os.Open(filepath.Join(r.staging, filepath.FromSlash(f.path)))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		var reader io.Reader = file
+		if strings.HasSuffix(name, ".gz") {
+			if reader, err = gzip.NewReader(file); err != nil {
+				return fmt.Errorf("%s: %w", f.path, err)
+			}
+		}
+		if strings.HasPrefix(name, "Packages") {
+			err = parseControl(reader, func(fields map[string]string) error {
+				size, err := strconv.ParseInt(fields["Size"], 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid Size of %s", fields["Filename"])
+				}
+				return a.addPool(r, fields["Filename"], size, fields["SHA256"])
+			})
+		} else {
+			err = parseControl(reader, func(fields map[string]string) error {
+				for _, line := range strings.Split(fields["Checksums-Sha256"], "\n") {
+					parts := strings.Fields(line)
+					if len(parts) != 3 {
+						continue
+					}
+					size, err := strconv.ParseInt(parts[1], 10, 64)
+					if err != nil {
+						return fmt.Errorf("invalid size of %s", parts[2])
+					}
+					if err := a.addPool(r, path.Join(fields["Directory"], parts[2]), size, parts[0]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.path, err)
+		}
+		return nil
+	}
+	return errors.New("no parseable Packages or Sources index")
+}
+
+// addPool adds a referenced file to pool, refusing paths outside of the archive or among indexes
+func (a *aptExecutor) addPool(r *aptRun, rel string, size int64, sum string) error {
+	if !fs.ValidPath(rel) || strings.HasPrefix(rel, "dists/") || strings.HasPrefix(rel, aptStagingDir+"/") {
+		return fmt.Errorf("invalid path of package %q", rel)
+	}
+	if sum == "" {
+		return fmt.Errorf("no SHA256 of %s", rel)
+	}
+	r.pool[rel] = a.remote(rel, size, sum)
+	return nil
+}
+
+// fetchPool downloads pool files which are missing. Pool files are never modified in place,
+// so existing files of the right size are trusted
+func (a *aptExecutor) fetchPool(r *aptRun) error {
+	var missing []remoteFile
+	for _, f := range r.pool {
+		r.transfer.TotalSize += f.size
+		if info, err := os.Stat(filepath.Join(r.path, filepath.FromSlash(f.path))); err == nil && info.Size() == f.size {
+			continue
+		}
+		missing = append(missing, f)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].path < missing[j].path })
+	if _, failed := a.fetch(r, r.path, missing, false); failed > 0 {
+		return fmt.Errorf("%d of %d pool files failed", failed, len(missing))
+	}
+	return nil
+}
+
+// publish moves staged indexes into place, and Release files after them
+func (a *aptExecutor) publish(r *aptRun) error {
+	for _, rel := range append(r.staged, r.releases...) {
+		dest := filepath.Join(r.path, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(r.staging, filepath.FromSlash(rel)), dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectGarbage removes pool files which are not referenced, and then empty directories
+func (a *aptExecutor) collectGarbage(r *aptRun) error {
+	root := filepath.Join(r.path, "pool")
+	var dirs []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		rel, err := filepath.Rel(r.path, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := r.pool[rel]; ok {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		fmt.Fprintf(&r.stdout, "deleted %s\n", rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs[:max(len(dirs)-1, 0)] {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
+
+func (a *aptExecutor) sync(r *aptRun, logger *logrus.Entry) error {
+	for _, suite := range a.suites {
+		entries, err := a.fetchRelease(r, suite)
+		if err != nil {
+			return err
+		}
+		selected := a.selectIndexes(entries)
+		if len(selected) == 0 {
+			return fmt.Errorf("no index of selected components and architectures in suite %s", suite)
+		}
+		for dir, indexes := range selected {
+			staged, err := a.stageIndexes(r, indexes)
+			if err != nil {
+				return err
+			}
+			if err := a.parseIndex(r, staged); err != nil {
+				return permanentError{fmt.Errorf("suite %s, %s: %w", suite, dir, err)}
+			}
+		}
+	}
+	logger.WithField("event", "apt_indexes_parsed").Debugf("%d pool files referenced", len(r.pool))
+	if err := a.fetchPool(r); err != nil {
+		return err
+	}
+	if err := a.publish(r); err != nil {
+		return err
+	}
+	if a.gc {
+		return a.collectGarbage(r)
+	}
+	return nil
+}
+
+func (a *aptExecutor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
+	dir := targetPath(ctx, a.path)
+	r := &aptRun{
+		ctx:     ctx,
+		path:    dir,
+		staging: filepath.Join(dir, aptStagingDir),
+		pool:    map[string]remoteFile{},
+	}
+	// indexes are small, so they are downloaded again rather than resumed
+	if err := os.RemoveAll(r.staging); err != nil {
+		return execResult{}, err
+	}
+	err := a.sync(r, logger)
+	_ = os.RemoveAll(r.staging)
+	return execResult{
+		Stdout:   r.stdout.String(),
+		Stderr:   r.stderr.String(),
+		Transfer: &r.transfer,
+	}, err
+}
+
+// clearsigned returns the message of a clearsigned file like InRelease, or content itself
+// if it is not signed
+func clearsigned(content string) string {
+	header, body, found := strings.Cut(content, "-----BEGIN PGP SIGNED MESSAGE-----\n")
+	if !found || strings.TrimSpace(header) != "" {
+		return content
+	}
+	// armor headers end with an empty line
+	_, body, _ = strings.Cut(body, "\n\n")
+	body, _, _ = strings.Cut(body, "-----BEGIN PGP SIGNATURE-----")
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		lines = append(lines, strings.TrimPrefix(line, "- "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseControl calls fn with fields of each paragraph in a Debian control file, like
+// Packages. Values of multiline fields keep their continuation lines, joined by newline
+func parseControl(r io.Reader, fn func(fields map[string]string) error) error {
+	scanner := bufio.NewScanner(r)
+	// descriptions could be long
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	fields := map[string]string{}
+	var last string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(fields) > 0 {
+				if err := fn(fields); err != nil {
+					return err
+				}
+				fields = map[string]string{}
+			}
+		case line[0] == ' ' || line[0] == '\t':
+			if last != "" {
+				fields[last] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			key, value, found := strings.Cut(line, ":")
+			if !found {
+				return fmt.Errorf("invalid line %q", line)
+			}
+			last = key
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		return fn(fields)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/sjtug/lug/pkg/tracing"
+)
+
+// errCannotStart is returned by command.run if the process cannot start
+var errCannotStart = errors.New("execution cannot start")
+
+// command is a process launched by executors
+type command struct {
+	name string
+	args []string
+	// env is appended to the environment of lug
+	env []string
+	// extraFiles are inherited by the process from fd 3
+	extraFiles []*os.File
+}
+
+// run launches the command with utilities hooked around its start, and waits for it to exit.
+// The exit code is -1 if the command cannot start. A span of the process is recorded in ctx,
+// whose TRACEPARENT is passed to the process, so that it could add child spans
+func (c command) run(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, int, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "exec")
+	defer span.End()
+	span.SetAttributes(attribute.String("process.executable.name", c.name))
+
+	logger.Debug("Invoking command:", c.name, "with args:", c.args)
+	cmd := exec.Command(c.name, c.args...)
+	env := append(os.Environ(), c.env...)
+	cmd.Env = append(env, tracing.Environ(ctx)...)
+	cmd.ExtraFiles = c.extraFiles
+
+	span.AddEvent("prehook")
+	for _, utility := range utilities {
+		logger.WithField("event", "exec_prehook").Debug("Executing prehook of ", utility)
+		if err := utility.preHook(); err != nil {
+			logger.Error("Failed to execute preHook:", err)
+		}
+	}
+
+	var bufErr, bufOut bytes.Buffer
+	cmd.Stdout = &bufOut
+	cmd.Stderr = &bufErr
+
+	err := cmd.Start()
+
+	span.AddEvent("posthook")
+	for _, utility := range utilities {
+		logger.WithField("event", "exec_posthook").Debug("Executing postHook of ", utility)
+		if err := utility.postHook(); err != nil {
+			logger.Error("Failed to execute postHook:", err)
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "execution cannot start")
+		return execResult{}, -1, errCannotStart
+	}
+	err = cmd.Wait()
+	exitCode := cmd.ProcessState.ExitCode()
+	span.SetAttributes(attribute.Int("process.exit.code", exitCode))
+	result := execResult{
+		Stdout: bufOut.String(),
+		Stderr: bufErr.String(),
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, exitCode, err
+}
@@ -0,0 +1,266 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partSuffix is appended to files being downloaded, which are renamed when complete
+const partSuffix = ".lug-part"
+
+// errNotFound is wrapped in errors of fetch if server responded 404
+var errNotFound = errors.New("not found")
+
+// newHTTPClient creates a client for executors downloading files. There is no overall
+// timeout since files could be huge, but servers must respond in time
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	return &http.Client{Transport: transport}
+}
+
+// httpDoer sends HTTP requests, like *http.Client or clients adding authentication to it
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// download describes a file to be downloaded by fetch
+type download struct {
+	url  string
+	dest string
+	// size is the expected size, -1 if unknown
+	size int64
+	// sha256 is the expected checksum in hex, empty if unknown
+	sha256 string
+	// conditional asks server to respond 304 if dest is not modified since its
+	// modification time, or still matches etag
+	conditional bool
+	etag        string
+}
+
+// downloadResult is the result of a successful fetch
+type downloadResult struct {
+	// modified is false if server responded 304 and dest is kept
+	modified bool
+	// etag of the downloaded file, empty if not given by server
+	etag string
+	// bytes received, excluding resumed part
+	bytes int64
+}
+
+// fetch downloads a file into dest atomically. Data is written to dest.lug-part first,
+// which is resumed in the next fetch if Last-Modified is known, and renamed to dest when
+// size and checksum are verified. Modification time of dest is set to Last-Modified
+func fetch(ctx context.Context, client httpDoer, dl download) (downloadResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.url, nil)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	part := dl.dest + partSuffix
+	var offset int64
+	if info, err := os.Stat(part); err == nil && info.Size() > 0 {
+		// resume only if the file is not changed since the part was written
+		offset = info.Size()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", info.ModTime().UTC().Format(http.TimeFormat))
+	} else if dl.conditional {
+		if dl.etag != "" {
+			req.Header.Set("If-None-Match", dl.etag)
+		}
+		if info, err := os.Stat(dl.dest); err == nil {
+			req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	defer resp.Body.Close()
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return downloadResult{etag: dl.etag}, nil
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return downloadResult{}, fmt.Errorf("GET %s: unexpected Content-Range %q", dl.url, resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusNotFound:
+		return downloadResult{}, fmt.Errorf("GET %s: %w", dl.url, errNotFound)
+	default:
+		return downloadResult{}, fmt.Errorf("GET %s: %s", dl.url, resp.Status)
+	}
+	size := dl.size
+	if size < 0 && resp.ContentLength >= 0 {
+		size = offset + resp.ContentLength
+	}
+	lastModified, lastModifiedErr := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err := os.MkdirAll(filepath.Dir(dl.dest), 0755); err != nil {
+		return downloadResult{}, err
+	}
+	file, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	written, err := io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// keep the part for resuming if it could be validated next time
+		if lastModifiedErr == nil {
+			_ = os.Chtimes(part, lastModified, lastModified)
+		} else {
+			_ = os.Remove(part)
+		}
+		return downloadResult{}, err
+	}
+	result := downloadResult{modified: true, etag: resp.Header.Get("ETag"), bytes: written}
+	if err := verify(part, size, dl.sha256); err != nil {
+		_ = os.Remove(part)
+		return result, fmt.Errorf("GET %s: %w", dl.url, err)
+	}
+	if err := os.Rename(part, dl.dest); err != nil {
+		return result, err
+	}
+	if lastModifiedErr == nil {
+		_ = os.Chtimes(dl.dest, lastModified, lastModified)
+	}
+	return result, nil
+}
+
+// verify checks size and sha256 of file, skipping unknown ones
+func verify(file string, size int64, sum string) error {
+	if size >= 0 {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.Size() != size {
+			return fmt.Errorf("size mismatch: expected %d, got %d", size, info.Size())
+		}
+	}
+	if sum == "" {
+		return nil
+	}
+	actual, err := sha256File(file)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, sum) {
+		return fmt.Errorf("sha256 mismatch: expected %s, got %s", sum, actual)
+	}
+	return nil
+}
+
+// sha256File returns sha256 of file in hex
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256Hex returns sha256 of data in hex
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseSize parses a size in manifests, where "-" means unknown
+func parseSize(s string) (int64, error) {
+	if s == "-" {
+		return -1, nil
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size, nil
+}
+
+// forEachParallel calls fn with 0 to n-1, running at most concurrency calls at a time
+func forEachParallel(n int, concurrency int, fn func(i int)) {
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// localPath returns where rel is stored under root, refusing paths which escape root
+func localPath(root string, rel string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("path %q escapes %s", rel, root)
+	}
+	return filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+// removeExtraneous removes files under root unless keep returns true for them or their
+// parts being downloaded, and then empty directories. Directories kept are not walked into
+func removeExtraneous(root string, keep func(rel string, dir bool) bool, deleted func(rel string)) error {
+	var dirs []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if keep(rel, true) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, p)
+			return nil
+		}
+		if keep(rel, false) || keep(strings.TrimSuffix(rel, partSuffix), false) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		deleted(rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// remove deeper directories first, and keep those which are not empty
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
@@ -1,14 +1,58 @@
 package worker
 
-import "github.com/sirupsen/logrus"
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/exporter"
+)
 
 type execResult struct {
 	Stdout string
 	Stderr string
+	// Metrics reported by the executor, nil if nothing is reported
+	Metrics []exporter.ScriptMetric
+	// Transfer accounting of the execution, nil if unknown
+	Transfer *exporter.TransferStats
+	// Git is the result of a git mirror sync, nil for other executors
+	Git *GitStats
+}
+
+// permanentError is returned by executors when retrying won't help, e.g. due to wrong options
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// publishAwareExecutor is implemented by stateful executors whose state describes the synced
+// tree. State of a successful run is applied only when its tree is published, which may
+// be discarded by a failed verification instead, and is dropped when the tree is rolled back
+type publishAwareExecutor interface {
+	// published applies state of the last successful run, whose tree is now served
+	published()
+	// rolledBack drops state, since the tree it describes is no longer served
+	rolledBack()
+}
+
+// statefulExecutor is implemented by executors keeping state across restarts in checkpoint,
+// e.g. the last synced serial of pypi executor, and by verifier
+type statefulExecutor interface {
+	// State returns state to be checkpointed. This call should be thread-safe
+	State() map[string]string
+	// Restore restores state loaded from checkpoint before any sync
+	Restore(state map[string]string)
 }
 
 // executor is a layer beneath worker, called by executorInvokeWorker
 type executor interface {
-	// When called, the executor performs sync for one time
-	RunOnce(logger *logrus.Entry, utilities []utility) (execResult, error)
+	// When called, the executor performs sync for one time. ctx carries the span of the attempt
+	RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error)
 }
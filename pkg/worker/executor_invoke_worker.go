@@ -1,12 +1,22 @@
 package worker
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"github.com/davecgh/go-spew/spew"
 	log "github.com/sirupsen/logrus"
 	"github.com/sjtug/lug/pkg/config"
 	"github.com/sjtug/lug/pkg/exporter"
 	"github.com/sjtug/lug/pkg/helper"
+	"github.com/sjtug/lug/pkg/logging"
+	"github.com/sjtug/lug/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,13 +28,24 @@ type executorInvokeWorker struct {
 	retry          int
 	retry_interval time.Duration
 	lastFinished   time.Time
+	lastEnded      time.Time
 	stdout         *helper.MaxLengthStringSliceAdaptor
 	stderr         *helper.MaxLengthStringSliceAdaptor
+	metrics        []exporter.ScriptMetric
+	transfer       *exporter.TransferStats
+	git            *GitStats
+	freshness      *freshnessProbe
+	snapshots      *snapshots
+	verifier       *verifier
 	cfg            config.RepoConfig
 	name           string
 	signal         chan int
 	logger         *log.Entry
 	rwmutex        sync.RWMutex
+	// failReason is why the last run failed after syncing, see Status
+	failReason string
+	// triggerCtx is the context passed to last trigger, consumed when the sync starts
+	triggerCtx context.Context
 }
 
 // creates a new executorInvokeWorker, which encapsules an executor
@@ -43,12 +64,13 @@ func NewExecutorInvokeWorker(exector executor, status Status,
 		retry:          3,
 		retry_interval: 3 * time.Second,
 		lastFinished:   status.LastFinished,
+		lastEnded:      status.LastEnded,
 		stdout:         helper.NewMaxLengthSlice(status.Stdout, 20),
 		stderr:         helper.NewMaxLengthSlice(status.Stderr, 20),
 		cfg:            cfg,
 		signal:         signal,
 		name:           name,
-		logger:         log.WithField("worker", name),
+		logger:         logging.Logger("worker").WithField("worker", name),
 		executor:       exector,
 	}
 	if retry_generic, ok := cfg["retry"]; ok {
@@ -66,24 +88,119 @@ func NewExecutorInvokeWorker(exector executor, status Status,
 			return nil, errors.New("retry_interval should be an integer when present")
 		}
 	}
+	freshness, err := newFreshnessProbe(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w.freshness = freshness
+	if w.snapshots, err = newSnapshots(cfg); err != nil {
+		return nil, err
+	}
+	if w.verifier, err = newVerifier(cfg); err != nil {
+		return nil, err
+	}
 	w.logger.Info(spew.Sprint(w))
 	return w, nil
 }
 
 func (eiw *executorInvokeWorker) TriggerSync() {
+	eiw.TriggerSyncWithContext(context.Background())
+}
+
+func (eiw *executorInvokeWorker) TriggerSyncWithContext(ctx context.Context) {
+	func() {
+		eiw.rwmutex.Lock()
+		defer eiw.rwmutex.Unlock()
+		eiw.triggerCtx = ctx
+	}()
 	eiw.signal <- 1
 }
 
 func (eiw *executorInvokeWorker) GetStatus() Status {
+	diskUsage, _ := exporter.GetInstance().GetDiskUsage(eiw.name)
 	eiw.rwmutex.RLock()
 	defer eiw.rwmutex.RUnlock()
-	return Status{
+	status := Status{
 		Idle:         eiw.idle,
 		Result:       eiw.result,
 		LastFinished: eiw.lastFinished,
+		LastEnded:    eiw.lastEnded,
+		DiskUsage:    diskUsage,
+		Metrics:      eiw.metrics,
+		Transfer:     eiw.transfer,
+		Git:          eiw.git,
+		FailReason:   eiw.failReason,
 		Stdout:       eiw.stdout.GetAll(),
 		Stderr:       eiw.stderr.GetAll(),
 	}
+	status.probeStatus(eiw.freshness)
+	if eiw.snapshots != nil {
+		status.Snapshot, _ = eiw.snapshots.current()
+	}
+	return status
+}
+
+// Rollback publishes the snapshot before the current one, which is refused while syncing
+func (eiw *executorInvokeWorker) Rollback() (string, error) {
+	if eiw.snapshots == nil {
+		return "", ErrSnapshotDisabled
+	}
+	var name, abandoned string
+	err := func() error {
+		// hold the lock so that no sync starts until current is swapped
+		eiw.rwmutex.Lock()
+		defer eiw.rwmutex.Unlock()
+		if !eiw.idle {
+			return ErrSyncing
+		}
+		var err error
+		if name, abandoned, err = eiw.snapshots.rollback(); err != nil {
+			return err
+		}
+		if e, ok := eiw.executor.(publishAwareExecutor); ok {
+			e.rolledBack()
+		}
+		return nil
+	}()
+	if err != nil {
+		return "", err
+	}
+	eiw.logger.WithField("event", "snapshot_rollback").Infof("Rolled back to snapshot %s", name)
+	// it may have been removed by a sync started meanwhile
+	_ = os.RemoveAll(abandoned)
+	return name, nil
+}
+
+// CheckpointState merges states of the executor and the verifier, whose keys do not overlap
+func (eiw *executorInvokeWorker) CheckpointState() map[string]string {
+	var state map[string]string
+	for _, s := range eiw.statefuls() {
+		for k, v := range s.State() {
+			if state == nil {
+				state = map[string]string{}
+			}
+			state[k] = v
+		}
+	}
+	return state
+}
+
+func (eiw *executorInvokeWorker) RestoreState(state map[string]string) {
+	for _, s := range eiw.statefuls() {
+		s.Restore(state)
+	}
+}
+
+// statefuls returns parts of the worker keeping state in checkpoint
+func (eiw *executorInvokeWorker) statefuls() []statefulExecutor {
+	var statefuls []statefulExecutor
+	if e, ok := eiw.executor.(statefulExecutor); ok {
+		statefuls = append(statefuls, e)
+	}
+	if eiw.verifier != nil {
+		statefuls = append(statefuls, eiw.verifier)
+	}
+	return statefuls
 }
 
 func (eiw *executorInvokeWorker) GetConfig() config.RepoConfig {
@@ -102,56 +219,183 @@ func (w *executorInvokeWorker) RunSync() {
 		}()
 		<-w.signal
 		w.logger.WithField("event", "signal_received").Debug("finished waiting for signal")
+		var ctx context.Context
 		func() {
 			w.rwmutex.Lock()
 			defer w.rwmutex.Unlock()
 			w.idle = false
+			ctx = w.triggerCtx
+			w.triggerCtx = nil
 		}()
-		w.logger.WithField("event", "start_execution").Info("start execution")
-		retry_limit := w.retry
-		var result execResult
-		var err error
-		for retry_cnt := 1; retry_cnt <= retry_limit; retry_cnt++ {
-			w.logger.WithField("event", "invoke_executor").WithField(
-				"try_cnt", retry_cnt).Debugf("Invoke executor for the %v time", retry_cnt)
-			utilities := []utility{newRlimit(w)}
-			result, err = w.executor.RunOnce(w.logger, utilities)
-			if err == nil {
-				break
-			}
-			w.logger.WithField("event", "invoke_executor_fail").WithField(
-				"try_cnt", retry_cnt).Infof(
-				"Failed on the %v-th executor. Error: %v", retry_cnt, err.Error())
-			w.logger.Debug("Stderr: ", result.Stderr)
-			time.Sleep(w.retry_interval)
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		w.sync(ctx)
+		// the span of trigger ends with the sync
+		trace.SpanFromContext(ctx).End()
+	}
+}
+
+// newRunID generates a random id of a run, which correlates its logs, outputs and spans
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sync performs a synchronization with retries, and records its result
+func (w *executorInvokeWorker) sync(ctx context.Context) {
+	runID := newRunID()
+	logger := w.logger.WithField("run_id", runID)
+	ctx, span := tracing.Tracer().Start(ctx, "run", trace.WithAttributes(
+		tracing.WorkerKey.String(w.name), attribute.String("lug.run_id", runID)))
+	defer span.End()
+	logger.WithField("event", "start_execution").Info("start execution")
+	startTime := time.Now()
+	exporter.GetInstance().SyncStart(w.name)
+	retry_limit := w.retry
+	var result execResult
+	var err error
+	var staging string
+	if w.snapshots != nil {
+		if staging, err = w.snapshots.stage(); err == nil {
+			ctx = withTarget(ctx, staging)
+		} else {
+			// nothing could be synced without a staging directory
+			retry_limit = 0
+		}
+	}
+	for retry_cnt := 1; retry_cnt <= retry_limit; retry_cnt++ {
+		logger.WithField("event", "invoke_executor").WithField(
+			"try_cnt", retry_cnt).Debugf("Invoke executor for the %v time", retry_cnt)
+		utilities := []utility{newRlimit(w)}
+		attemptCtx, attemptSpan := tracing.Tracer().Start(ctx, "attempt", trace.WithAttributes(
+			tracing.WorkerKey.String(w.name), attribute.Int("lug.attempt", retry_cnt)))
+		result, err = w.executor.RunOnce(attemptCtx, logger, utilities)
+		logging.ShipOutput(w.name, runID, "stdout", result.Stdout)
+		logging.ShipOutput(w.name, runID, "stderr", result.Stderr)
+		if err == nil {
+			attemptSpan.End()
+			break
+		}
+		attemptSpan.RecordError(err)
+		attemptSpan.SetStatus(codes.Error, err.Error())
+		attemptSpan.End()
+		logger.WithField("event", "invoke_executor_fail").WithField(
+			"try_cnt", retry_cnt).Infof(
+			"Failed on the %v-th executor. Error: %v", retry_cnt, err.Error())
+		logger.Debug("Stderr: ", result.Stderr)
+		if errors.As(err, &permanentError{}) {
+			logger.WithField("event", "invoke_executor_abort").Info("Not retrying since the error is permanent")
+			break
 		}
+		if retry_cnt < retry_limit {
+			exporter.GetInstance().SyncRetry(w.name)
+		}
+		time.Sleep(w.retry_interval)
+	}
+	failReason := ""
+	var tree verifiedTree
+	if err == nil && w.verifier != nil {
+		verifyCtx, verifySpan := tracing.Tracer().Start(ctx, "verify", trace.WithAttributes(tracing.WorkerKey.String(w.name)))
+		path, _ := w.cfg["path"].(string)
+		var verifyResult execResult
+		verifyResult, tree, err = w.verifier.verify(verifyCtx, logger, []utility{newRlimit(w)}, targetPath(ctx, path))
+		result.Stdout += verifyResult.Stdout
+		result.Stderr += verifyResult.Stderr
 		if err != nil {
-			w.logger.WithField("event", "execution_fail").Error(err.Error())
-			exporter.GetInstance().SyncFail(w.name)
-			func() {
-				w.rwmutex.Lock()
-				defer w.rwmutex.Unlock()
-				w.result = false
-				w.stdout.Put(result.Stdout)
-				w.stderr.Put(result.Stderr)
-				w.logger.Infof("Stderr: %s", result.Stderr)
-				w.logger.Debugf("Stdout: %s", result.Stdout)
-				w.idle = true
-			}()
-			continue
-		}
-
-		exporter.GetInstance().SyncSuccess(w.name)
-		w.logger.WithField("event", "execution_succeed").Info("succeed")
-		w.logger.Infof("Stderr: %s", result.Stderr)
+			// the sync is not retried, since the upstream is likely inconsistent as well
+			failReason = FailVerification
+			verifySpan.RecordError(err)
+			verifySpan.SetStatus(codes.Error, err.Error())
+			logger.WithField("event", "verification_fail").Warn(err.Error())
+		}
+		verifySpan.End()
+	}
+	_, postSpan := tracing.Tracer().Start(ctx, "post_sync", trace.WithAttributes(tracing.WorkerKey.String(w.name)))
+	defer postSpan.End()
+	if staging != "" {
+		var name string
+		if err == nil {
+			name, err = w.snapshots.publish(staging)
+		}
+		if err != nil {
+			_ = os.RemoveAll(staging)
+		} else {
+			logger.WithField("event", "snapshot_published").Infof("Published snapshot %s", name)
+			// the run is published anyway, and pruning is retried after the next one
+			if pruneErr := w.snapshots.prune(); pruneErr != nil {
+				logger.WithField("event", "snapshot_prune_failed").Warn(pruneErr)
+			}
+		}
+	}
+	if err == nil {
+		// the tree is served from now on, so later runs are compared with it
+		if w.verifier != nil {
+			w.verifier.accept(tree)
+		}
+		if e, ok := w.executor.(publishAwareExecutor); ok {
+			e.published()
+		}
+	}
+	exporter.GetInstance().SetScriptMetrics(w.name, result.Metrics)
+	// metrics are also kept in the record of the run, i.e. its log tagged with run_id, and
+	// shipped to Loki next to its outputs
+	resultLogger := logger
+	if len(result.Metrics) > 0 {
+		metrics := exporter.FormatScriptMetrics(result.Metrics)
+		resultLogger = logger.WithField("metrics", metrics)
+		logging.ShipOutput(w.name, runID, "metrics", strings.Join(metrics, "\n"))
+	}
+	if result.Transfer != nil {
+		exporter.GetInstance().SetTransferStats(w.name, *result.Transfer)
+	}
+	func() {
+		w.rwmutex.Lock()
+		defer w.rwmutex.Unlock()
+		w.metrics = result.Metrics
+		w.transfer = result.Transfer
+		if result.Git != nil {
+			w.git = result.Git
+		}
+		w.failReason = failReason
+	}()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		resultLogger.WithField("event", "execution_fail").Error(err.Error())
+		exporter.GetInstance().SyncFail(w.name, time.Since(startTime))
 		func() {
 			w.rwmutex.Lock()
 			defer w.rwmutex.Unlock()
-			w.stderr.Put(result.Stderr)
-			w.logger.Debugf("Stdout: %s", result.Stdout)
+			w.result = false
+			w.lastEnded = time.Now()
 			w.stdout.Put(result.Stdout)
-			w.result = true
-			w.lastFinished = time.Now()
+			w.stderr.Put(result.Stderr)
+			logger.Infof("Stderr: %s", result.Stderr)
+			logger.Debugf("Stdout: %s", result.Stdout)
+			w.idle = true
 		}()
+		return
+	}
+
+	exporter.GetInstance().SyncSuccess(w.name, time.Since(startTime))
+	if path, ok := w.cfg["path"].(string); ok {
+		exporter.GetInstance().UpdateDiskUsage(w.name, path)
+	}
+	if w.freshness != nil {
+		w.freshness.Refresh()
 	}
+	resultLogger.WithField("event", "execution_succeed").Info("succeed")
+	logger.Infof("Stderr: %s", result.Stderr)
+	func() {
+		w.rwmutex.Lock()
+		defer w.rwmutex.Unlock()
+		w.stderr.Put(result.Stderr)
+		logger.Debugf("Stdout: %s", result.Stdout)
+		w.stdout.Put(result.Stdout)
+		w.result = true
+		w.lastFinished = time.Now()
+		w.lastEnded = w.lastFinished
+	}()
 }
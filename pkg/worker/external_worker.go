@@ -1,20 +1,26 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
+	"github.com/sjtug/lug/pkg/logging"
 )
 
 // ExternalWorker is a stub worker which always returns
-// {Idle: false, Result: true}.
+// {Idle: false, Result: true}, unless its freshness probe fails.
 type ExternalWorker struct {
-	name   string
-	logger *log.Entry
-	cfg    config.RepoConfig
+	name      string
+	logger    *log.Entry
+	cfg       config.RepoConfig
+	created   time.Time
+	freshness *freshnessProbe
 }
 
 func NewExternalWorker(cfg config.RepoConfig) (*ExternalWorker, error) {
@@ -23,21 +29,40 @@ func NewExternalWorker(cfg config.RepoConfig) (*ExternalWorker, error) {
 		return nil, errors.New("Name is required for external worker")
 	}
 	name := rawName.(string)
+	freshness, err := newFreshnessProbe(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &ExternalWorker{
-		name:   name,
-		logger: log.WithField("worker", name),
-		cfg:    cfg,
+		name:      name,
+		logger:    logging.Logger("worker").WithField("worker", name),
+		cfg:       cfg,
+		created:   time.Now(),
+		freshness: freshness,
 	}, nil
 }
 
 func (ew *ExternalWorker) GetStatus() Status {
-	return Status{
-		Result:       true,
-		LastFinished: time.Now(),
-		Idle:         true,
-		Stdout:       []string{},
-		Stderr:       []string{},
+	diskUsage, _ := exporter.GetInstance().GetDiskUsage(ew.name)
+	status := Status{
+		Result: true,
+		// external worker never syncs, so the status is settled when it is created
+		LastEnded: ew.created,
+		DiskUsage: diskUsage,
+		Idle:      true,
+		Stdout:    []string{},
+		Stderr:    []string{},
+	}
+	status.probeStatus(ew.freshness)
+	// the mirror is known to be fine only when it was last probed successfully
+	if ew.freshness != nil {
+		status.LastFinished = ew.freshness.LastSuccess()
+	}
+	// the upstream being proxied is unreachable
+	if status.UpstreamError != "" {
+		status.Result = false
 	}
+	return status
 }
 
 func (ew *ExternalWorker) RunSync() {
@@ -48,6 +73,11 @@ func (ew *ExternalWorker) RunSync() {
 func (ew *ExternalWorker) TriggerSync() {
 }
 
+func (ew *ExternalWorker) TriggerSyncWithContext(ctx context.Context) {
+	// nothing to sync, so the span ends at once
+	trace.SpanFromContext(ctx).End()
+}
+
 func (ew *ExternalWorker) GetConfig() config.RepoConfig {
 	return ew.cfg
 }
@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// defaultFreshnessInterval is used if "freshness_interval" is not specified
+const defaultFreshnessInterval = 300
+
+// freshnessContentLimit is the maximum bytes read from a freshness file
+const freshnessContentLimit = 64 * 1024
+
+// timeLayouts are accepted formats of timestamps in freshness files, e.g. output of date(1)
+var timeLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+	"Mon, _2 Jan 2006 15:04:05 MST",
+	"Mon, _2 Jan 2006 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+}
+
+// freshnessProbe finds out when upstream data was updated, from Last-Modified of
+// "freshness_url" or contents of "freshness_file". Probes run in background and
+// results are cached for "freshness_interval" seconds
+type freshnessProbe struct {
+	url      string
+	file     string
+	interval time.Duration
+	client   *http.Client
+	updated  time.Time
+	err      error
+	checked  time.Time
+	// succeeded is when the last successful probe finished
+	succeeded time.Time
+	probing   bool
+	mutex     sync.Mutex
+}
+
+// newFreshnessProbe creates a probe from config, or returns nil if it is not configured
+func newFreshnessProbe(cfg config.RepoConfig) (*freshnessProbe, error) {
+	p := &freshnessProbe{
+		interval: defaultFreshnessInterval * time.Second,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if url, ok := cfg["freshness_url"]; ok {
+		if p.url, ok = url.(string); !ok {
+			return nil, errors.New("freshness_url should be a string when present")
+		}
+	}
+	if file, ok := cfg["freshness_file"]; ok {
+		if p.file, ok = file.(string); !ok {
+			return nil, errors.New("freshness_file should be a string when present")
+		}
+	}
+	if interval, ok := cfg["freshness_interval"]; ok {
+		seconds, ok := interval.(int)
+		if !ok || seconds <= 0 {
+			return nil, errors.New("freshness_interval should be a positive integer when present")
+		}
+		p.interval = time.Duration(seconds) * time.Second
+	}
+	if p.url != "" && p.file != "" {
+		return nil, errors.New("freshness_url and freshness_file can't be set together")
+	}
+	if p.url == "" && p.file == "" {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// Get returns the last result of probe, and launches another one in background if the
+// result is older than interval. A zero time and nil error mean nothing is probed yet
+func (p *freshnessProbe) Get() (time.Time, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.probing && time.Since(p.checked) > p.interval {
+		p.launch()
+	}
+	return p.updated, p.err
+}
+
+// LastSuccess returns when the last successful probe finished, or zero time if none succeeded
+func (p *freshnessProbe) LastSuccess() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.succeeded
+}
+
+// Refresh launches a probe in background regardless of interval, e.g. after a sync
+func (p *freshnessProbe) Refresh() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.probing {
+		p.launch()
+	}
+}
+
+// launch probes in background. Call it with mutex held
+func (p *freshnessProbe) launch() {
+	p.probing = true
+	go func() {
+		updated, err := p.probe()
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.updated, p.err = updated, err
+		p.checked = time.Now()
+		if err == nil {
+			p.succeeded = p.checked
+		}
+		p.probing = false
+	}()
+}
+
+func (p *freshnessProbe) probe() (time.Time, error) {
+	if p.url != "" {
+		return p.probeURL()
+	}
+	return p.probeFile()
+}
+
+// probeURL uses Last-Modified of the URL, or its contents if the header is absent
+func (p *freshnessProbe) probeURL() (time.Time, error) {
+	resp, err := p.client.Head(p.url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("probe %s: %s", p.url, resp.Status)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		return http.ParseTime(lastModified)
+	}
+	resp, err = p.client.Get(p.url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("probe %s: %s", p.url, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, freshnessContentLimit))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, ok := parseFreshness(content); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("probe %s: neither Last-Modified nor timestamp found", p.url)
+}
+
+// probeFile uses the timestamp in the file, or its modification time
+func (p *freshnessProbe) probeFile() (time.Time, error) {
+	file, err := os.Open(p.file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, freshnessContentLimit))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, ok := parseFreshness(content); ok {
+		return t, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// parseFreshness finds the timestamp in contents of a freshness file, which is either
+// the Date field of Debian Release file, or the whole file like a lastsync file
+func parseFreshness(content []byte) (time.Time, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if date, found := strings.CutPrefix(scanner.Text(), "Date:"); found {
+			return parseTimestamp(date)
+		}
+	}
+	return parseTimestamp(string(content))
+}
+
+// parseTimestamp parses a unix timestamp, or time in one of timeLayouts
+func parseTimestamp(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,190 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// defaultGCInterval is used if "gc_interval" is not specified
+const defaultGCInterval = 86400
+
+// gcMarker is a file in the mirror whose modification time is when maintenance ran last time
+const gcMarker = "lug-last-gc"
+
+// GitStats is the result of a git mirror sync
+type GitStats struct {
+	// Head is the commit HEAD points to, empty if the repository is empty
+	Head string
+	// UpdatedRefs counts refs created, updated or deleted by the sync
+	UpdatedRefs int
+}
+
+// gitExecutor implements executor interface by maintaining a bare mirror clone of source in path
+type gitExecutor struct {
+	source string
+	path   string
+	// lfs fetches LFS objects of all refs
+	lfs bool
+	// gcInterval is the minimum interval between maintenance, 0 if disabled
+	gcInterval time.Duration
+}
+
+func newGitExecutor(cfg config.RepoConfig) (*gitExecutor, error) {
+	source, err := stringOption(cfg, "source")
+	if err != nil {
+		return nil, err
+	}
+	path, err := stringOption(cfg, "path")
+	if err != nil {
+		return nil, err
+	}
+	if source == "" || path == "" {
+		return nil, errors.New("source and path are required by git worker")
+	}
+	g := &gitExecutor{
+		source:     source,
+		path:       path,
+		gcInterval: defaultGCInterval * time.Second,
+	}
+	if lfs, ok := cfg["lfs"]; ok {
+		if g.lfs, ok = lfs.(bool); !ok {
+			return nil, errors.New("lfs should be a boolean when present")
+		}
+	}
+	if gcInterval, ok := cfg["gc_interval"]; ok {
+		seconds, ok := gcInterval.(int)
+		if !ok || seconds < 0 {
+			return nil, errors.New("gc_interval should be a non-negative integer when present")
+		}
+		g.gcInterval = time.Duration(seconds) * time.Second
+	}
+	return g, nil
+}
+
+// gitRun runs git commands of a sync, collecting their outputs
+type gitRun struct {
+	ctx context.Context
+	// path is the repository synced in this run, see targetPath
+	path      string
+	logger    *logrus.Entry
+	utilities []utility
+	stdout    strings.Builder
+	stderr    strings.Builder
+}
+
+// git runs a git command. Its stdout is returned instead of collected if quiet is true
+func (r *gitRun) git(quiet bool, args ...string) (string, error) {
+	// never ask for credentials on terminal
+	cmd := command{name: "git", args: args, env: []string{"GIT_TERMINAL_PROMPT=0"}}
+	result, _, err := cmd.run(r.ctx, r.logger, r.utilities)
+	if !quiet {
+		r.stdout.WriteString(result.Stdout)
+	}
+	r.stderr.WriteString(result.Stderr)
+	if errors.Is(err, errCannotStart) {
+		return "", permanentError{err}
+	}
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w", args[len(args)-1], err)
+	}
+	return result.Stdout, nil
+}
+
+// refs lists refs of the mirror, as refname -> object name
+func (g *gitExecutor) refs(r *gitRun) (map[string]string, error) {
+	output, err := r.git(true, "-C", r.path, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if object, ref, found := strings.Cut(scanner.Text(), " "); found {
+			refs[ref] = object
+		}
+	}
+	return refs, nil
+}
+
+// maintain runs gc and writes commit-graph if gcInterval has elapsed since last time
+func (g *gitExecutor) maintain(r *gitRun) error {
+	if g.gcInterval == 0 {
+		return nil
+	}
+	marker := filepath.Join(r.path, gcMarker)
+	if info, err := os.Stat(marker); err == nil && time.Since(info.ModTime()) < g.gcInterval {
+		return nil
+	}
+	if _, err := r.git(false, "-C", r.path, "gc", "--quiet"); err != nil {
+		return err
+	}
+	if _, err := r.git(false, "-C", r.path, "commit-graph", "write", "--reachable"); err != nil {
+		return err
+	}
+	return os.WriteFile(marker, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+}
+
+func (g *gitExecutor) sync(r *gitRun) (*GitStats, error) {
+	before := map[string]string{}
+	if _, err := os.Stat(filepath.Join(r.path, "HEAD")); os.IsNotExist(err) {
+		if _, err := r.git(false, "clone", "--mirror", g.source, r.path); err != nil {
+			return nil, err
+		}
+	} else {
+		if before, err = g.refs(r); err != nil {
+			return nil, err
+		}
+		// follow changes of source in config
+		if _, err := r.git(false, "-C", r.path, "remote", "set-url", "origin", g.source); err != nil {
+			return nil, err
+		}
+		if _, err := r.git(false, "-C", r.path, "fetch", "--prune", "origin"); err != nil {
+			return nil, err
+		}
+	}
+	if g.lfs {
+		if _, err := r.git(false, "-C", r.path, "lfs", "fetch", "--all", "origin"); err != nil {
+			return nil, err
+		}
+	}
+	after, err := g.refs(r)
+	if err != nil {
+		return nil, err
+	}
+	stats := &GitStats{}
+	for ref, object := range after {
+		if before[ref] != object {
+			stats.UpdatedRefs++
+		}
+	}
+	for ref := range before {
+		if _, ok := after[ref]; !ok {
+			stats.UpdatedRefs++
+		}
+	}
+	// HEAD is unborn in an empty repository
+	if head, err := r.git(true, "-C", r.path, "rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+		stats.Head = strings.TrimSpace(head)
+	}
+	return stats, g.maintain(r)
+}
+
+func (g *gitExecutor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
+	r := &gitRun{ctx: ctx, path: targetPath(ctx, g.path), logger: logger, utilities: utilities}
+	stats, err := g.sync(r)
+	return execResult{
+		Stdout: r.stdout.String(),
+		Stderr: r.stderr.String(),
+		Git:    stats,
+	}, err
+}
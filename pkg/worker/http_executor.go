@@ -0,0 +1,377 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
+)
+
+// httpStateFile keeps ETag and verified checksum of files in path of http worker
+const httpStateFile = ".lug-http.json"
+
+// defaultConcurrency is used if "concurrency" is not specified
+const defaultConcurrency = 4
+
+// listingLimit is the maximum bytes read from a directory listing or manifest
+const listingLimit = 64 * 1024 * 1024
+
+// hrefPattern matches links in autoindex listings of nginx, Apache, lighttpd and Go
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+// remoteFile is a file found in listing or manifest
+type remoteFile struct {
+	// path is relative to source, separated by slash
+	path string
+	url  string
+	// size is -1 if unknown
+	size int64
+	// sha256 is empty if unknown
+	sha256 string
+}
+
+// httpFileState is what is remembered about a downloaded file
+type httpFileState struct {
+	ETag   string `json:"etag,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// httpExecutor implements executor interface by downloading files in an autoindex
+// listing, or in a manifest, from source into path
+type httpExecutor struct {
+	source *url.URL
+	// manifest is URL of the manifest, empty if the listing is crawled
+	manifest    string
+	path        string
+	concurrency int
+	// delete removes local files which are not found upstream
+	delete  bool
+	exclude []string
+	client  *http.Client
+}
+
+func newHTTPExecutor(cfg config.RepoConfig) (*httpExecutor, error) {
+	source, err := stringOption(cfg, "source")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := stringOption(cfg, "path")
+	if err != nil {
+		return nil, err
+	}
+	if source == "" || dir == "" {
+		return nil, errors.New("source and path are required by http worker")
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		return nil, errors.New("source should be an http or https URL")
+	}
+	if !strings.HasSuffix(sourceURL.Path, "/") {
+		sourceURL.Path += "/"
+	}
+	h := &httpExecutor{
+		source:      sourceURL,
+		path:        dir,
+		concurrency: defaultConcurrency,
+		client:      newHTTPClient(),
+	}
+	manifest, err := stringOption(cfg, "manifest")
+	if err != nil {
+		return nil, err
+	}
+	if manifest != "" {
+		manifestURL, err := sourceURL.Parse(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest: %w", err)
+		}
+		h.manifest = manifestURL.String()
+	}
+	if concurrency, ok := cfg["concurrency"]; ok {
+		if h.concurrency, ok = concurrency.(int); !ok || h.concurrency <= 0 {
+			return nil, errors.New("concurrency should be a positive integer when present")
+		}
+	}
+	if del, ok := cfg["delete"]; ok {
+		if h.delete, ok = del.(bool); !ok {
+			return nil, errors.New("delete should be a boolean when present")
+		}
+	}
+	exclude, err := stringOption(cfg, "exclude")
+	if err != nil {
+		return nil, err
+	}
+	h.exclude = strings.Fields(exclude)
+	for _, pattern := range h.exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q", pattern)
+		}
+	}
+	return h, nil
+}
+
+// excluded returns whether rel matches exclude patterns. Like rsync, patterns with a slash
+// match the whole path, patterns ending with a slash match only directories, and others
+// match the base name
+func (h *httpExecutor) excluded(rel string, dir bool) bool {
+	rel = strings.TrimSuffix(rel, "/")
+	for _, pattern := range h.exclude {
+		dirOnly := strings.HasSuffix(pattern, "/")
+		if dirOnly && !dir {
+			continue
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// get fetches a listing or manifest
+func (h *httpExecutor) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, listingLimit))
+}
+
+// crawl lists files by following links to children in listings, starting from source
+func (h *httpExecutor) crawl(ctx context.Context) ([]remoteFile, error) {
+	var files []remoteFile
+	queue := []*url.URL{h.source}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		listing, err := h.get(ctx, dir.String())
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, match := range hrefPattern.FindAllStringSubmatch(string(listing), -1) {
+			ref, err := url.Parse(html.UnescapeString(match[1]))
+			if err != nil || ref.RawQuery != "" {
+				// skip sorting links of autoindex
+				continue
+			}
+			ref.Fragment = ""
+			link := dir.ResolveReference(ref)
+			if link.Scheme != dir.Scheme || link.Host != dir.Host {
+				continue
+			}
+			name, found := strings.CutPrefix(link.Path, dir.Path)
+			// only direct children are followed, which also skips parent directory
+			if !found || strings.Trim(name, "/") == "" || strings.Contains(strings.TrimSuffix(name, "/"), "/") || seen[name] {
+				continue
+			}
+			seen[name] = true
+			rel := strings.TrimPrefix(link.Path, h.source.Path)
+			// escaped dot segments like %2e%2e/ are not resolved, and must not escape path
+			if !fs.ValidPath(strings.TrimSuffix(rel, "/")) {
+				continue
+			}
+			isDir := strings.HasSuffix(name, "/")
+			if h.excluded(rel, isDir) {
+				continue
+			}
+			if isDir {
+				queue = append(queue, link)
+			} else {
+				files = append(files, remoteFile{path: rel, url: link.String(), size: -1})
+			}
+		}
+	}
+	return files, nil
+}
+
+// readManifest lists files in manifest. Each line is path, size ("-" if unknown) and
+// optionally sha256, separated by spaces. Empty lines and lines starting with # are ignored
+func (h *httpExecutor) readManifest(ctx context.Context) ([]remoteFile, error) {
+	content, err := h.get(ctx, h.manifest)
+	if err != nil {
+		return nil, err
+	}
+	var files []remoteFile
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("manifest line %d: expected path, size and optional sha256", line)
+		}
+		rel := fields[0]
+		if !fs.ValidPath(rel) || rel == "." {
+			return nil, fmt.Errorf("manifest line %d: invalid path %q", line, rel)
+		}
+		size, err := parseSize(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("manifest line %d: %w", line, err)
+		}
+		file := remoteFile{path: rel, url: h.source.ResolveReference(&url.URL{Path: rel}).String(), size: size}
+		if len(fields) == 3 {
+			file.sha256 = strings.ToLower(fields[2])
+		}
+		if !h.excluded(rel, false) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// loadState reads state of downloaded files in dir, which is empty if missing or corrupted
+func (h *httpExecutor) loadState(dir string) map[string]httpFileState {
+	state := map[string]httpFileState{}
+	if content, err := os.ReadFile(filepath.Join(dir, httpStateFile)); err == nil {
+		_ = json.Unmarshal(content, &state)
+	}
+	return state
+}
+
+// saveState writes state of files found upstream into dir
+func (h *httpExecutor) saveState(dir string, state map[string]httpFileState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, httpStateFile+partSuffix)
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, httpStateFile))
+}
+
+// syncFile downloads f into dir if it is new or changed, and returns its new state
+func (h *httpExecutor) syncFile(ctx context.Context, dir string, f remoteFile, state httpFileState) (downloadResult, httpFileState, error) {
+	dest, err := localPath(dir, f.path)
+	if err != nil {
+		return downloadResult{}, httpFileState{}, err
+	}
+	info, err := os.Stat(dest)
+	exists := err == nil && info.Mode().IsRegular()
+	if exists && f.sha256 != "" && state.SHA256 == f.sha256 && info.Size() == f.size {
+		return downloadResult{etag: state.ETag}, state, nil
+	}
+	dl := download{url: f.url, dest: dest, size: f.size, sha256: f.sha256}
+	// without a checksum, trust the server to tell whether the file is modified
+	dl.conditional = exists && f.sha256 == "" && (f.size < 0 || info.Size() == f.size)
+	if dl.conditional {
+		dl.etag = state.ETag
+	}
+	result, err := fetch(ctx, h.client, dl)
+	if err != nil {
+		return result, httpFileState{}, err
+	}
+	return result, httpFileState{ETag: result.etag, SHA256: f.sha256}, nil
+}
+
+// deleteRemoved removes files in dir not in files, and then empty directories. Only files
+// found under dir are removed, whatever paths are in files
+func (h *httpExecutor) deleteRemoved(dir string, files []remoteFile, deleted func(rel string)) error {
+	keep := map[string]bool{httpStateFile: true}
+	for _, f := range files {
+		keep[f.path] = true
+	}
+	return removeExtraneous(dir, func(rel string, dir bool) bool {
+		return h.excluded(rel, dir) || (!dir && keep[rel])
+	}, deleted)
+}
+
+func (h *httpExecutor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
+	var files []remoteFile
+	var err error
+	if h.manifest != "" {
+		files, err = h.readManifest(ctx)
+	} else {
+		files, err = h.crawl(ctx)
+	}
+	if err != nil {
+		return execResult{}, err
+	}
+	logger.WithField("event", "http_listed").Debugf("%d files found upstream", len(files))
+
+	var stdout, stderr strings.Builder
+	var transfer exporter.TransferStats
+	var failed int
+	var mutex sync.Mutex
+	dir := targetPath(ctx, h.path)
+	oldState := h.loadState(dir)
+	state := map[string]httpFileState{}
+	forEachParallel(len(files), h.concurrency, func(i int) {
+		f := files[i]
+		result, fileState, err := h.syncFile(ctx, dir, f, oldState[f.path])
+		mutex.Lock()
+		defer mutex.Unlock()
+		transfer.BytesReceived += result.bytes
+		if err != nil {
+			failed++
+			fmt.Fprintf(&stderr, "%s: %v\n", f.path, err)
+			return
+		}
+		state[f.path] = fileState
+		if result.modified {
+			transfer.FilesTransferred++
+			fmt.Fprintf(&stdout, "downloaded %s\n", f.path)
+		}
+	})
+	if err := h.saveState(dir, state); err != nil {
+		logger.WithField("event", "http_save_state_failed").Warn(err)
+	}
+	result := execResult{Transfer: &transfer}
+	switch {
+	case failed > 0:
+		err = fmt.Errorf("%d of %d files failed", failed, len(files))
+	case h.delete && len(files) == 0:
+		// an empty listing is more likely to be a broken upstream than an empty mirror
+		logger.WithField("event", "http_delete_skipped").Warn("Nothing found upstream, deletion skipped")
+	case h.delete:
+		err = h.deleteRemoved(dir, files, func(rel string) {
+			fmt.Fprintf(&stdout, "deleted %s\n", rel)
+		})
+	}
+	for _, f := range files {
+		dest, pathErr := localPath(dir, f.path)
+		if pathErr != nil {
+			continue
+		}
+		if info, statErr := os.Stat(dest); statErr == nil {
+			transfer.TotalSize += info.Size()
+		}
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	return result, err
+}
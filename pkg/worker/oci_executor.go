@@ -0,0 +1,551 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
+)
+
+// ociManifestTypes are media types of manifests and indexes accepted from registries
+var ociManifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ociRefName is the annotation of manifests in index.json naming the image, as repository:tag
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// ociManifestLimit is the maximum size of a manifest, like most registries
+const ociManifestLimit = 4 * 1024 * 1024
+
+// ociRepoPattern extracts the repository from path of a registry API
+var ociRepoPattern = regexp.MustCompile(`^/v2/(.+)/(?:manifests|blobs|tags)/`)
+
+// ociChallengeParam matches parameters of WWW-Authenticate
+var ociChallengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// ociDescriptor describes a blob or manifest
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest has fields of both image manifest and index, to find what they reference
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Config    *ociDescriptor  `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ociImage is a repository and a tag pattern to be mirrored
+type ociImage struct {
+	repository string
+	tag        string
+}
+
+// ociClient is an httpDoer which authenticates to registry with bearer tokens or basic auth
+// as challenged by WWW-Authenticate. Tokens are cached by repository
+type ociClient struct {
+	client       *http.Client
+	username     string
+	passwordFile string
+	tokens       map[string]string
+	mutex        sync.Mutex
+}
+
+// credentials returns username and password, if configured
+func (c *ociClient) credentials() (string, string, bool, error) {
+	if c.username == "" {
+		return "", "", false, nil
+	}
+	password, err := os.ReadFile(c.passwordFile)
+	if err != nil {
+		return "", "", false, err
+	}
+	return c.username, strings.TrimSpace(string(password)), true, nil
+}
+
+// authenticate gets the authorization header answering challenge
+func (c *ociClient) authenticate(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	username, password, hasCredentials, err := c.credentials()
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(scheme, "Basic") {
+		if !hasCredentials {
+			return "", errors.New("registry requires credentials")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization"), nil
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported authentication %q", challenge)
+	}
+	values := map[string]string{}
+	for _, match := range ociChallengeParam.FindAllStringSubmatch(params, -1) {
+		values[strings.ToLower(match[1])] = match[2]
+	}
+	realm, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return "", fmt.Errorf("invalid realm in %q", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if values[key] != "" {
+			query.Set(key, values[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCredentials {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", realm.Redacted(), resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+func (c *ociClient) Do(req *http.Request) (*http.Response, error) {
+	var repository string
+	if match := ociRepoPattern.FindStringSubmatch(req.URL.Path); match != nil {
+		repository = match[1]
+	}
+	c.mutex.Lock()
+	authorization := c.tokens[repository]
+	c.mutex.Unlock()
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	authorization, err = c.authenticate(req.Context(), resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.tokens[repository] = authorization
+	c.mutex.Unlock()
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", authorization)
+	return c.client.Do(retry)
+}
+
+// ociExecutor implements executor interface by copying images matching patterns from a
+// registry into an OCI image layout in path. Blobs are shared by all images, and index.json
+// naming the images is written after all blobs are verified
+type ociExecutor struct {
+	source      *url.URL
+	path        string
+	images      []ociImage
+	concurrency int
+	// gc removes blobs which are not referenced by any image
+	gc     bool
+	client *ociClient
+}
+
+func newOCIExecutor(cfg config.RepoConfig) (*ociExecutor, error) {
+	options := map[string]string{}
+	for _, key := range []string{"source", "path", "images", "username", "password_file"} {
+		value, err := stringOption(cfg, key)
+		if err != nil {
+			return nil, err
+		}
+		options[key] = value
+	}
+	if options["source"] == "" || options["path"] == "" || options["images"] == "" {
+		return nil, errors.New("source, path and images are required by oci worker")
+	}
+	sourceURL, err := url.Parse(options["source"])
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		return nil, errors.New("source should be an http or https URL")
+	}
+	if (options["username"] == "") != (options["password_file"] == "") {
+		return nil, errors.New("username and password_file should be set together")
+	}
+	o := &ociExecutor{
+		source:      sourceURL,
+		path:        options["path"],
+		concurrency: defaultConcurrency,
+		gc:          true,
+		client: &ociClient{
+			client:       newHTTPClient(),
+			username:     options["username"],
+			passwordFile: options["password_file"],
+			tokens:       map[string]string{},
+		},
+	}
+	for _, image := range strings.Fields(options["images"]) {
+		repository, tag, found := strings.Cut(image, ":")
+		if !found {
+			tag = "latest"
+		}
+		if _, err := path.Match(tag, ""); err != nil || repository == "" || tag == "" {
+			return nil, fmt.Errorf("invalid image %q", image)
+		}
+		o.images = append(o.images, ociImage{repository: repository, tag: tag})
+	}
+	if gc, ok := cfg["gc"]; ok {
+		if o.gc, ok = gc.(bool); !ok {
+			return nil, errors.New("gc should be a boolean when present")
+		}
+	}
+	if concurrency, ok := cfg["concurrency"]; ok {
+		if o.concurrency, ok = concurrency.(int); !ok || o.concurrency <= 0 {
+			return nil, errors.New("concurrency should be a positive integer when present")
+		}
+	}
+	return o, nil
+}
+
+// api returns URL of a registry API of repository
+func (o *ociExecutor) api(repository string, kind string, reference string) string {
+	return o.source.JoinPath("v2", repository, kind, reference).String()
+}
+
+// blobPath returns where a blob is stored, refusing digests other than sha256
+func (r *ociRun) blobPath(digest string) (string, string, error) {
+	hex, found := strings.CutPrefix(digest, "sha256:")
+	if !found || len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return "", "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(r.path, "blobs", "sha256", hex), hex, nil
+}
+
+// tags lists tags of image matching its pattern, following pagination of Link header
+func (o *ociExecutor) tags(ctx context.Context, image ociImage) ([]string, error) {
+	if !strings.ContainsAny(image.tag, `*?[\`) {
+		return []string{image.tag}, nil
+	}
+	var tags []string
+	next := o.api(image.repository, "tags", "list")
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := o.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", next, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range list.Tags {
+			if matched, _ := path.Match(image.tag, tag); matched {
+				tags = append(tags, tag)
+			}
+		}
+		next = ""
+		if link := resp.Header.Get("Link"); strings.Contains(link, `rel="next"`) {
+			target := strings.Trim(strings.SplitN(link, ";", 2)[0], " <>")
+			nextURL, err := req.URL.Parse(target)
+			if err != nil {
+				return nil, err
+			}
+			next = nextURL.String()
+		}
+	}
+	return tags, nil
+}
+
+// ociRun is the state of a sync of oci worker
+type ociRun struct {
+	ctx context.Context
+	// path is the image layout synced in this run, see targetPath
+	path     string
+	stdout   strings.Builder
+	stderr   strings.Builder
+	transfer exporter.TransferStats
+	// referenced are digests of all blobs and manifests of images
+	referenced map[string]bool
+	mutex      sync.Mutex
+}
+
+// fetchManifest stores a manifest by reference if it is missing, verifying its digest, and
+// returns its descriptor and content
+func (o *ociExecutor) fetchManifest(r *ociRun, repository string, reference string) (ociDescriptor, []byte, error) {
+	if strings.HasPrefix(reference, "sha256:") {
+		// manifests are content addressed, so stored ones are reused
+		if file, _, err := r.blobPath(reference); err == nil {
+			if content, err := os.ReadFile(file); err == nil {
+				var m ociManifest
+				if err := json.Unmarshal(content, &m); err == nil {
+					return ociDescriptor{MediaType: m.MediaType, Digest: reference, Size: int64(len(content))}, content, nil
+				}
+			}
+		}
+	}
+	u := o.api(repository, "manifests", reference)
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return ociDescriptor{}, nil, err
+	}
+	req.Header.Set("Accept", strings.Join(ociManifestTypes, ", "))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return ociDescriptor{}, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ociDescriptor{}, nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, ociManifestLimit))
+	if err != nil {
+		return ociDescriptor{}, nil, err
+	}
+	digest := "sha256:" + sha256Hex(content)
+	for _, expected := range []string{resp.Header.Get("Docker-Content-Digest"), reference} {
+		if strings.HasPrefix(expected, "sha256:") && expected != digest {
+			return ociDescriptor{}, nil, fmt.Errorf("GET %s: digest mismatch: expected %s, got %s", u, expected, digest)
+		}
+	}
+	var m ociManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return ociDescriptor{}, nil, fmt.Errorf("GET %s: %w", u, err)
+	}
+	descriptor := ociDescriptor{MediaType: m.MediaType, Digest: digest, Size: int64(len(content))}
+	if descriptor.MediaType == "" {
+		descriptor.MediaType = strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	}
+	file, _, err := r.blobPath(digest)
+	if err != nil {
+		return ociDescriptor{}, nil, err
+	}
+	if _, err := os.Stat(file); err != nil {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return ociDescriptor{}, nil, err
+		}
+		if err := os.WriteFile(file+partSuffix, content, 0644); err != nil {
+			return ociDescriptor{}, nil, err
+		}
+		if err := os.Rename(file+partSuffix, file); err != nil {
+			return ociDescriptor{}, nil, err
+		}
+		r.mutex.Lock()
+		r.transfer.FilesTransferred++
+		r.transfer.BytesReceived += descriptor.Size
+		fmt.Fprintf(&r.stdout, "stored manifest %s@%s\n", repository, digest)
+		r.mutex.Unlock()
+	}
+	return descriptor, content, nil
+}
+
+// fetchBlobs downloads blobs which are missing in parallel, verifying their digests
+func (o *ociExecutor) fetchBlobs(r *ociRun, repository string, blobs []ociDescriptor) error {
+	var failed int
+	forEachParallel(len(blobs), o.concurrency, func(i int) {
+		blob := blobs[i]
+		file, hex, err := r.blobPath(blob.Digest)
+		if err == nil {
+			if _, statErr := os.Stat(file); statErr == nil {
+				return
+			}
+			var result downloadResult
+			result, err = fetch(r.ctx, o.client, download{
+				url:    o.api(repository, "blobs", blob.Digest),
+				dest:   file,
+				size:   blob.Size,
+				sha256: hex,
+			})
+			r.mutex.Lock()
+			r.transfer.BytesReceived += result.bytes
+			r.mutex.Unlock()
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if err != nil {
+			failed++
+			fmt.Fprintf(&r.stderr, "%s@%s: %v\n", repository, blob.Digest, err)
+			return
+		}
+		r.transfer.FilesTransferred++
+		fmt.Fprintf(&r.stdout, "downloaded blob %s@%s\n", repository, blob.Digest)
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d of %d blobs of %s failed", failed, len(blobs), repository)
+	}
+	return nil
+}
+
+// copyManifest copies a manifest and everything it references, manifests of an index
+// before the index itself
+func (o *ociExecutor) copyManifest(r *ociRun, repository string, reference string) (ociDescriptor, error) {
+	descriptor, content, err := o.fetchManifest(r, repository, reference)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	var m ociManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return ociDescriptor{}, err
+	}
+	for _, child := range m.Manifests {
+		if _, err := o.copyManifest(r, repository, child.Digest); err != nil {
+			return ociDescriptor{}, err
+		}
+	}
+	var blobs []ociDescriptor
+	seen := map[string]bool{}
+	for _, blob := range m.Layers {
+		if !seen[blob.Digest] {
+			seen[blob.Digest] = true
+			blobs = append(blobs, blob)
+		}
+	}
+	if m.Config != nil && !seen[m.Config.Digest] {
+		blobs = append([]ociDescriptor{*m.Config}, blobs...)
+	}
+	if err := o.fetchBlobs(r, repository, blobs); err != nil {
+		return ociDescriptor{}, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.referenced[descriptor.Digest] = true
+	for _, blob := range blobs {
+		r.referenced[blob.Digest] = true
+		r.transfer.TotalSize += blob.Size
+	}
+	return descriptor, nil
+}
+
+// writeIndex writes oci-layout and index.json atomically
+func (o *ociExecutor) writeIndex(r *ociRun, manifests []ociDescriptor) error {
+	if err := os.MkdirAll(r.path, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(r.path, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestTypes[0],
+		"manifests":     manifests,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	index := filepath.Join(r.path, "index.json")
+	if err := os.WriteFile(index+partSuffix, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(index+partSuffix, index)
+}
+
+// collectGarbage removes blobs which are not referenced
+func (o *ociExecutor) collectGarbage(r *ociRun) error {
+	dir := filepath.Join(r.path, "blobs", "sha256")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		digest := "sha256:" + strings.TrimSuffix(entry.Name(), partSuffix)
+		if r.referenced[digest] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		fmt.Fprintf(&r.stdout, "deleted blob %s\n", digest)
+	}
+	return nil
+}
+
+func (o *ociExecutor) sync(r *ociRun, logger *logrus.Entry) error {
+	var manifests []ociDescriptor
+	for _, image := range o.images {
+		tags, err := o.tags(r.ctx, image)
+		if err != nil {
+			return err
+		}
+		// an empty tag list is more likely to be a broken registry than removed images, so
+		// index.json is kept and no blob is collected
+		if len(tags) == 0 {
+			return fmt.Errorf("no tag of %s matches %s", image.repository, image.tag)
+		}
+		for _, tag := range tags {
+			descriptor, err := o.copyManifest(r, image.repository, tag)
+			if err != nil {
+				return fmt.Errorf("%s:%s: %w", image.repository, tag, err)
+			}
+			descriptor.Annotations = map[string]string{ociRefName: image.repository + ":" + tag}
+			manifests = append(manifests, descriptor)
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].Annotations[ociRefName] < manifests[j].Annotations[ociRefName]
+	})
+	if err := o.writeIndex(r, manifests); err != nil {
+		return err
+	}
+	if o.gc {
+		return o.collectGarbage(r)
+	}
+	return nil
+}
+
+func (o *ociExecutor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
+	r := &ociRun{ctx: ctx, path: targetPath(ctx, o.path), referenced: map[string]bool{}}
+	err := o.sync(r, logger)
+	return execResult{
+		Stdout:   r.stdout.String(),
+		Stderr:   r.stderr.String(),
+		Transfer: &r.transfer,
+	}, err
+}
@@ -0,0 +1,431 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
+)
+
+// defaultPyPISource is used if "source" is not specified
+const defaultPyPISource = "https://pypi.org/simple/"
+
+// pypiJSONType is the content type of PEP 691 JSON simple API
+const pypiJSONType = "application/vnd.pypi.simple.v1+json"
+
+// pypiJSONPage is the name of JSON pages written besides index.html, like bandersnatch
+const pypiJSONPage = "index.v1_json"
+
+// pypiNameSeparators are normalized to "-" in project names by PEP 503
+var pypiNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// pypiAnchorPattern matches anchors in PEP 503 HTML pages, capturing attributes and text
+var pypiAnchorPattern = regexp.MustCompile(`(?is)<a\s([^>]*)>([^<]*)</a>`)
+
+// pypiAttrPattern matches attributes of an anchor
+var pypiAttrPattern = regexp.MustCompile(`([a-zA-Z-]+)\s*=\s*"([^"]*)"`)
+
+// normalizeProject normalizes a project name as PEP 503 does
+func normalizeProject(name string) string {
+	return strings.ToLower(pypiNameSeparators.ReplaceAllString(name, "-"))
+}
+
+// pypiProject is a project in the index page
+type pypiProject struct {
+	Name string `json:"name"`
+	// Serial is the last serial of the project, 0 if the index doesn't tell
+	Serial int64 `json:"_last-serial,omitempty"`
+}
+
+// pypiPage is a page of simple API in JSON. Files are kept as maps, so that fields unknown
+// to lug are mirrored as well
+type pypiPage struct {
+	Meta     map[string]any   `json:"meta"`
+	Name     string           `json:"name,omitempty"`
+	Projects []pypiProject    `json:"projects,omitempty"`
+	Files    []map[string]any `json:"files,omitempty"`
+	Versions []string         `json:"versions,omitempty"`
+}
+
+// serial returns _last-serial in meta, 0 if absent
+func (p *pypiPage) serial() int64 {
+	serial, _ := p.Meta["_last-serial"].(float64)
+	return int64(serial)
+}
+
+// pypiExecutor implements executor interface by mirroring projects of a PEP 503/691 simple
+// index. Projects are synced only if their serial is newer than the last synced one, which
+// is kept in checkpoint
+type pypiExecutor struct {
+	source      *url.URL
+	path        string
+	allowlist   []string
+	denylist    []string
+	concurrency int
+	client      *http.Client
+	// serial is the serial of index when it is completely synced and published last time
+	serial int64
+	// synced is the serial of index completely synced by the last successful run, which
+	// becomes serial when the run is published
+	synced int64
+	mutex  sync.Mutex
+}
+
+func newPyPIExecutor(cfg config.RepoConfig) (*pypiExecutor, error) {
+	options := map[string]string{}
+	for _, key := range []string{"source", "path", "allowlist", "denylist"} {
+		value, err := stringOption(cfg, key)
+		if err != nil {
+			return nil, err
+		}
+		options[key] = value
+	}
+	if options["path"] == "" {
+		return nil, errors.New("path is required by pypi worker")
+	}
+	if options["source"] == "" {
+		options["source"] = defaultPyPISource
+	}
+	sourceURL, err := url.Parse(options["source"])
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") {
+		return nil, errors.New("source should be an http or https URL")
+	}
+	if !strings.HasSuffix(sourceURL.Path, "/") {
+		sourceURL.Path += "/"
+	}
+	p := &pypiExecutor{
+		source:      sourceURL,
+		path:        options["path"],
+		allowlist:   strings.Fields(options["allowlist"]),
+		denylist:    strings.Fields(options["denylist"]),
+		concurrency: defaultConcurrency,
+		client:      newHTTPClient(),
+	}
+	for _, pattern := range append(p.allowlist, p.denylist...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid project pattern %q", pattern)
+		}
+	}
+	if concurrency, ok := cfg["concurrency"]; ok {
+		if p.concurrency, ok = concurrency.(int); !ok || p.concurrency <= 0 {
+			return nil, errors.New("concurrency should be a positive integer when present")
+		}
+	}
+	return p, nil
+}
+
+func (p *pypiExecutor) State() map[string]string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return map[string]string{"serial": strconv.FormatInt(p.serial, 10)}
+}
+
+func (p *pypiExecutor) Restore(state map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.serial, _ = strconv.ParseInt(state["serial"], 10, 64)
+}
+
+// allowed returns whether a normalized project name matches allowlist (if not empty) and
+// doesn't match denylist
+func (p *pypiExecutor) allowed(name string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(normalizeProject(pattern), name); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(p.allowlist) == 0 || matches(p.allowlist)) && !matches(p.denylist)
+}
+
+// getPage fetches a page of simple API, preferring JSON and falling back to HTML
+func (p *pypiExecutor) getPage(ctx context.Context, u *url.URL) (*pypiPage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", pypiJSONType+", text/html;q=0.1")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("GET %s: %w", u, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, listingLimit))
+	if err != nil {
+		return nil, err
+	}
+	page := &pypiPage{}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == pypiJSONType {
+		if err := json.Unmarshal(body, page); err != nil {
+			return nil, fmt.Errorf("GET %s: %w", u, err)
+		}
+		return page, nil
+	}
+	// PEP 503 HTML page, where the serial is in a header of PyPI
+	page.Meta = map[string]any{}
+	if serial, err := strconv.ParseInt(resp.Header.Get("X-PyPI-Last-Serial"), 10, 64); err == nil {
+		page.Meta["_last-serial"] = float64(serial)
+	}
+	for _, match := range pypiAnchorPattern.FindAllStringSubmatch(string(body), -1) {
+		attrs := map[string]string{}
+		for _, attr := range pypiAttrPattern.FindAllStringSubmatch(match[1], -1) {
+			attrs[strings.ToLower(attr[1])] = html.UnescapeString(attr[2])
+		}
+		text := strings.TrimSpace(html.UnescapeString(match[2]))
+		href, hasHref := attrs["href"]
+		if !hasHref {
+			continue
+		}
+		page.Projects = append(page.Projects, pypiProject{Name: text})
+		file := map[string]any{"filename": text, "url": href, "hashes": map[string]any{}}
+		if base, fragment, found := strings.Cut(href, "#"); found {
+			file["url"] = base
+			if algorithm, digest, found := strings.Cut(fragment, "="); found {
+				file["hashes"] = map[string]any{algorithm: digest}
+			}
+		}
+		if requiresPython, ok := attrs["data-requires-python"]; ok {
+			file["requires-python"] = requiresPython
+		}
+		if yanked, ok := attrs["data-yanked"]; ok {
+			if yanked == "" {
+				file["yanked"] = true
+			} else {
+				file["yanked"] = yanked
+			}
+		}
+		page.Files = append(page.Files, file)
+	}
+	return page, nil
+}
+
+// pypiRun is the state of a sync of pypi worker
+type pypiRun struct {
+	ctx context.Context
+	// path is the mirror synced in this run, see targetPath
+	path     string
+	stdout   strings.Builder
+	stderr   strings.Builder
+	transfer exporter.TransferStats
+	mutex    sync.Mutex
+}
+
+// syncProject downloads files of a project, and then writes its pages
+func (p *pypiExecutor) syncProject(r *pypiRun, name string) error {
+	pageURL := p.source.ResolveReference(&url.URL{Path: name + "/"})
+	page, err := p.getPage(r.ctx, pageURL)
+	if errors.Is(err, errNotFound) {
+		// the project is removed after the index is fetched
+		return os.RemoveAll(filepath.Join(r.path, "simple", name))
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range page.Files {
+		filename, _ := file["filename"].(string)
+		rawURL, _ := file["url"].(string)
+		fileURL, err := pageURL.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("invalid url of %s: %w", filename, err)
+		}
+		// files are kept at the same path as upstream, e.g. packages/ab/cd/...
+		rel := strings.TrimPrefix(fileURL.Path, "/")
+		if !fs.ValidPath(rel) || rel == "." || strings.HasPrefix(rel, "simple/") {
+			return fmt.Errorf("invalid path of %s: %q", filename, rel)
+		}
+		hashes, _ := file["hashes"].(map[string]any)
+		sum, _ := hashes["sha256"].(string)
+		size := int64(-1)
+		if s, ok := file["size"].(float64); ok {
+			size = int64(s)
+		}
+		if err := p.fetchFile(r, fileURL.String(), rel, size, sum); err != nil {
+			return err
+		}
+		// make the url relative to simple/<project>/
+		file["url"] = "../../" + rel
+	}
+	// anchors of HTML pages are parsed as both
+	page.Projects = nil
+	return p.writePages(filepath.Join(r.path, "simple", name), page)
+}
+
+// fetchFile downloads a distribution file if it is missing. Files on PyPI are never
+// modified, so existing files are trusted if their size, or checksum if size is unknown, matches
+func (p *pypiExecutor) fetchFile(r *pypiRun, fileURL string, rel string, size int64, sum string) error {
+	dest := filepath.Join(r.path, filepath.FromSlash(rel))
+	if info, err := os.Stat(dest); err == nil {
+		if size >= 0 && info.Size() == size {
+			return nil
+		}
+		if size < 0 && verify(dest, -1, sum) == nil && sum != "" {
+			return nil
+		}
+	}
+	result, err := fetch(r.ctx, p.client, download{url: fileURL, dest: dest, size: size, sha256: sum})
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.transfer.BytesReceived += result.bytes
+	if err != nil {
+		return err
+	}
+	r.transfer.FilesTransferred++
+	fmt.Fprintf(&r.stdout, "downloaded %s\n", rel)
+	return nil
+}
+
+// writePages writes page in JSON and HTML into dir atomically
+func (p *pypiExecutor) writePages(dir string, page *pypiPage) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if page.Meta == nil {
+		page.Meta = map[string]any{}
+	}
+	page.Meta["api-version"] = "1.1"
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	// keep specifiers like >=3.8 as is
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(page); err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head><meta name=\"pypi:repository-version\" content=\"1.1\"></head>\n<body>\n")
+	for _, project := range page.Projects {
+		b.WriteString("<a href=\"" + html.EscapeString(project.Name) + "/\">" + html.EscapeString(project.Name) + "</a><br/>\n")
+	}
+	for _, file := range page.Files {
+		filename, _ := file["filename"].(string)
+		href, _ := file["url"].(string)
+		if hashes, ok := file["hashes"].(map[string]any); ok {
+			if sum, ok := hashes["sha256"].(string); ok {
+				href += "#sha256=" + sum
+			}
+		}
+		b.WriteString("<a href=\"" + html.EscapeString(href) + "\"")
+		if requiresPython, ok := file["requires-python"].(string); ok && requiresPython != "" {
+			b.WriteString(" data-requires-python=\"" + html.EscapeString(requiresPython) + "\"")
+		}
+		switch yanked := file["yanked"].(type) {
+		case string:
+			b.WriteString(" data-yanked=\"" + html.EscapeString(yanked) + "\"")
+		case bool:
+			if yanked {
+				b.WriteString(" data-yanked=\"\"")
+			}
+		}
+		b.WriteString(">" + html.EscapeString(filename) + "</a><br/>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	for name, data := range map[string][]byte{pypiJSONPage: content.Bytes(), "index.html": []byte(b.String())} {
+		tmp := filepath.Join(dir, name+partSuffix)
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pypiExecutor) sync(r *pypiRun, logger *logrus.Entry) error {
+	index, err := p.getPage(r.ctx, p.source)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	lastSerial := p.serial
+	p.mutex.Unlock()
+	var projects []pypiProject
+	var outdated []string
+	for _, project := range index.Projects {
+		name := normalizeProject(project.Name)
+		if !p.allowed(name) {
+			continue
+		}
+		projects = append(projects, pypiProject{Name: name, Serial: project.Serial})
+		_, err := os.Stat(filepath.Join(r.path, "simple", name, pypiJSONPage))
+		// projects without serial in index are always synced
+		if project.Serial == 0 || project.Serial > lastSerial || err != nil {
+			outdated = append(outdated, name)
+		}
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	logger.WithField("event", "pypi_outdated").Debugf("%d of %d projects are outdated since serial %d",
+		len(outdated), len(projects), lastSerial)
+	var failed int
+	forEachParallel(len(outdated), p.concurrency, func(i int) {
+		if err := p.syncProject(r, outdated[i]); err != nil {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			failed++
+			fmt.Fprintf(&r.stderr, "%s: %v\n", outdated[i], err)
+		}
+	})
+	if failed > 0 {
+		// serial is not advanced, so failed projects are synced next time
+		return fmt.Errorf("%d of %d projects failed", failed, len(outdated))
+	}
+	index.Projects = projects
+	index.Files = nil
+	if err := p.writePages(filepath.Join(r.path, "simple"), index); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.synced = index.serial()
+	return nil
+}
+
+func (p *pypiExecutor) published() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.serial = p.synced
+}
+
+// rolledBack forgets serial, so that all projects are checked against the index next time
+func (p *pypiExecutor) rolledBack() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.serial = 0
+}
+
+func (p *pypiExecutor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
+	r := &pypiRun{ctx: ctx, path: targetPath(ctx, p.path)}
+	err := p.sync(r, logger)
+	return execResult{
+		Stdout:   r.stdout.String(),
+		Stderr:   r.stderr.String(),
+		Transfer: &r.transfer,
+	}, err
+}
@@ -0,0 +1,207 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"mvdan.cc/sh/v3/shell"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// rsyncDeletePolicies maps "delete" option to rsync flags
+var rsyncDeletePolicies = map[string][]string{
+	"none":   nil,
+	"during": {"--delete-during"},
+	"after":  {"--delete-after"},
+	// files are updated and deleted at the end of transfer, leaving the shortest window of inconsistency
+	"delay": {"--delete-delay", "--delay-updates"},
+}
+
+// rsyncRetryableCodes are exit codes of rsync caused by network or upstream, which are worth
+// retrying. 23 (partial transfer due to error) is not among them, since it is usually caused
+// by permissions or I/O errors of specific files, which a retry does not fix
+var rsyncRetryableCodes = map[int]string{
+	5:  "error starting client-server protocol",
+	10: "error in socket I/O",
+	12: "error in rsync protocol data stream",
+	30: "timeout in data send/receive",
+	35: "timeout waiting for daemon connection",
+}
+
+// defaultIndexPatterns match index files of Debian-style archives, which reference other files
+const defaultIndexPatterns = "Packages* Sources* Release* InRelease Contents-* Translation-* ls-lR* i18n/ dep11/ by-hash/"
+
+// rsyncExecutor implements executor interface by invoking rsync with options in config
+type rsyncExecutor struct {
+	// stages are arguments of rsync invoked one by one. With two_stage, files except
+	// indexes are synced without deletion first, so that indexes never reference
+	// missing files, and then indexes are synced with deletion
+	stages [][]string
+}
+
+// stringOption gets an optional string from config
+func stringOption(cfg config.RepoConfig, key string) (string, error) {
+	value, ok := cfg[key]
+	if !ok {
+		return "", nil
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return "", errors.New(key + " should be a string when present")
+}
+
+func newRsyncExecutor(cfg config.RepoConfig) (*rsyncExecutor, error) {
+	source, err := stringOption(cfg, "source")
+	if err != nil {
+		return nil, err
+	}
+	path, err := stringOption(cfg, "path")
+	if err != nil {
+		return nil, err
+	}
+	if source == "" || path == "" {
+		return nil, errors.New("source and path are required by rsync worker")
+	}
+	args := []string{"-rtlH", "--safe-links", "--partial-dir=.rsync-partial", "--stats"}
+
+	deletePolicy, err := stringOption(cfg, "delete")
+	if err != nil {
+		return nil, err
+	}
+	if deletePolicy == "" {
+		deletePolicy = "delay"
+	}
+	deleteArgs, ok := rsyncDeletePolicies[deletePolicy]
+	if !ok {
+		return nil, errors.New("delete should be none, during, after or delay when present")
+	}
+	if timeout, ok := cfg["timeout"]; ok {
+		seconds, ok := timeout.(int)
+		if !ok || seconds < 0 {
+			return nil, errors.New("timeout should be a non-negative integer when present")
+		}
+		args = append(args, fmt.Sprintf("--timeout=%d", seconds))
+	}
+	if bwlimit, ok := cfg["bwlimit"]; ok {
+		switch bwlimit.(type) {
+		case int, string:
+			args = append(args, fmt.Sprintf("--bwlimit=%v", bwlimit))
+		default:
+			return nil, errors.New("bwlimit should be an integer in KiB/s or a size like 10m when present")
+		}
+	}
+	passwordFile, err := stringOption(cfg, "password_file")
+	if err != nil {
+		return nil, err
+	}
+	// password is only accepted from a file, since config of workers is logged
+	if passwordFile != "" {
+		args = append(args, "--password-file="+passwordFile)
+	}
+	// patterns are separated by spaces, since nested values are not allowed in repo config
+	exclude, err := stringOption(cfg, "exclude")
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range strings.Fields(exclude) {
+		args = append(args, "--exclude="+pattern)
+	}
+	excludeFrom, err := stringOption(cfg, "exclude_from")
+	if err != nil {
+		return nil, err
+	}
+	if excludeFrom != "" {
+		args = append(args, "--exclude-from="+excludeFrom)
+	}
+	extraArgs, err := stringOption(cfg, "extra_args")
+	if err != nil {
+		return nil, err
+	}
+	extra, err := shell.Fields(extraArgs, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse extra_args: %w", err)
+	}
+	args = append(args, extra...)
+	// sync contents of source into path
+	locations := []string{strings.TrimSuffix(source, "/") + "/", strings.TrimSuffix(path, "/") + "/"}
+
+	twoStage := false
+	if value, ok := cfg["two_stage"]; ok {
+		if twoStage, ok = value.(bool); !ok {
+			return nil, errors.New("two_stage should be a boolean when present")
+		}
+	}
+	indexPatterns, err := stringOption(cfg, "index_patterns")
+	if err != nil {
+		return nil, err
+	}
+	if indexPatterns == "" {
+		indexPatterns = defaultIndexPatterns
+	}
+	var stages [][]string
+	if twoStage {
+		stage := append([]string{}, args...)
+		for _, pattern := range strings.Fields(indexPatterns) {
+			stage = append(stage, "--exclude="+pattern)
+		}
+		stages = append(stages, append(stage, locations...))
+	}
+	stage := append(append([]string{}, args...), deleteArgs...)
+	stages = append(stages, append(stage, locations...))
+	return &rsyncExecutor{
+		stages: stages,
+	}, nil
+}
+
+// classifyRsyncExit interprets exit code of rsync. Vanished files are not errors for mirrors,
+// and only errors caused by network or upstream are retried
+func classifyRsyncExit(logger *logrus.Entry, exitCode int, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errCannotStart):
+		return permanentError{err}
+	case exitCode == 24:
+		logger.WithField("event", "rsync_vanished_files").Warn("Some files vanished before they could be transferred")
+		return nil
+	}
+	if reason, ok := rsyncRetryableCodes[exitCode]; ok {
+		return fmt.Errorf("rsync exited with %d: %s", exitCode, reason)
+	}
+	return permanentError{fmt.Errorf("rsync exited with %d", exitCode)}
+}
+
+// RunOnce runs all stages as one attempt. Outputs of stages are concatenated, so that
+// transfer accounting sums up all stages
+func (r *rsyncExecutor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
+	var stdout, stderr strings.Builder
+	var err error
+	for i, args := range r.stages {
+		stageLogger := logger.WithField("stage", i+1)
+		stageLogger.WithField("event", "rsync_stage").Debugf("Start stage %d of %d", i+1, len(r.stages))
+		// the destination is the last argument, replaced by the snapshot being staged if any
+		args = append(args[:len(args)-1:len(args)-1], strings.TrimSuffix(targetPath(ctx, args[len(args)-1]), "/")+"/")
+		cmd := command{name: "rsync", args: args}
+		var result execResult
+		var exitCode int
+		result, exitCode, err = cmd.run(ctx, stageLogger, utilities)
+		stdout.WriteString(result.Stdout)
+		stderr.WriteString(result.Stderr)
+		if err = classifyRsyncExit(stageLogger, exitCode, err); err != nil {
+			if len(r.stages) > 1 {
+				err = fmt.Errorf("stage %d: %w", i+1, err)
+			}
+			break
+		}
+	}
+	return execResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Transfer: parseRsyncStats(stdout.String()),
+	}, err
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/sjtug/lug/pkg/exporter"
+)
+
+// numbers in rsync --stats may contain thousands separators, or units when -h is given
+const rsyncNumber = `([0-9][0-9,.]*[KMGTP]?)`
+
+var (
+	rsyncFilesTransferred = regexp.MustCompile(`Number of (?:regular )?files transferred: ` + rsyncNumber)
+	rsyncBytesReceived    = regexp.MustCompile(`Total bytes received: ` + rsyncNumber)
+	rsyncTotalSize        = regexp.MustCompile(`total size is ` + rsyncNumber + `\s+speedup is ` + rsyncNumber)
+)
+
+// parseRsyncNumber parses numbers like 1,234 or 1.23M printed by rsync
+func parseRsyncNumber(s string) (float64, bool) {
+	s = strings.ReplaceAll(s, ",", "")
+	if strings.ContainsAny(s, "KMGTP") {
+		bytes, err := humanize.ParseBytes(s)
+		return float64(bytes), err == nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// parseRsyncStats extracts transfer accounting from output of rsync --stats. When rsync
+// is invoked several times, files and bytes are summed up, while total size and speedup
+// come from the last invocation. It returns nil if no statistics are found.
+func parseRsyncStats(output string) *exporter.TransferStats {
+	totals := rsyncTotalSize.FindAllStringSubmatch(output, -1)
+	if len(totals) == 0 {
+		return nil
+	}
+	var stats exporter.TransferStats
+	last := totals[len(totals)-1]
+	if size, ok := parseRsyncNumber(last[1]); ok {
+		stats.TotalSize = int64(size)
+	}
+	if speedup, ok := parseRsyncNumber(last[2]); ok {
+		stats.Speedup = speedup
+	}
+	for _, match := range rsyncFilesTransferred.FindAllStringSubmatch(output, -1) {
+		if files, ok := parseRsyncNumber(match[1]); ok {
+			stats.FilesTransferred += int64(files)
+		}
+	}
+	for _, match := range rsyncBytesReceived.FindAllStringSubmatch(output, -1) {
+		if bytes, ok := parseRsyncNumber(match[1]); ok {
+			stats.BytesReceived += int64(bytes)
+		}
+	}
+	return &stats
+}
@@ -0,0 +1,676 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
+)
+
+const (
+	// defaultS3Region is used if "region" is not specified
+	defaultS3Region = "us-east-1"
+	// defaultMultipartThreshold is used if "multipart_threshold" is not specified, in MiB
+	defaultMultipartThreshold = 64
+	// defaultPartSize is used if "part_size" is not specified, in MiB
+	defaultPartSize = 16
+	// s3UnsignedPayload is used instead of checksum of body, which is protected by Content-MD5
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3EmptyPayload is sha256 of empty body
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Escape escapes s as AWS Signature Version 4 requires, leaving only unreserved
+// characters, and slash if path is true
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Signer signs requests with AWS Signature Version 4
+type s3Signer struct {
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+}
+
+// sign adds Authorization to req sent at now. host, range, content-md5 and x-amz-* headers
+// are signed, and x-amz-content-sha256 is set to UNSIGNED-PAYLOAD unless present
+func (s s3Signer) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "range" || key == "content-md5" || strings.HasPrefix(key, "x-amz-") {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Client is an httpDoer signing requests to the bucket. The secret is read from file,
+// or AWS_SECRET_ACCESS_KEY if not configured
+type s3Client struct {
+	client      *http.Client
+	endpoint    *url.URL
+	bucket      string
+	region      string
+	accessKeyID string
+	secretFile  string
+}
+
+func (c *s3Client) Do(req *http.Request) (*http.Response, error) {
+	signer := s3Signer{region: c.region, accessKeyID: c.accessKeyID, secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY")}
+	if c.secretFile != "" {
+		secret, err := os.ReadFile(c.secretFile)
+		if err != nil {
+			return nil, err
+		}
+		signer.secretAccessKey = strings.TrimSpace(string(secret))
+	}
+	signer.sign(req, time.Now())
+	return c.client.Do(req)
+}
+
+// url returns URL of key in path style, which is supported by all S3-compatible storages
+func (c *s3Client) url(key string, query url.Values) *url.URL {
+	u := c.endpoint.JoinPath(c.bucket, key)
+	// send the path escaped in the same way as signed
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = query.Encode()
+	return u
+}
+
+// s3Error is the error response of S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// request sends a request about key, and returns the response if it succeeds
+func (c *s3Client) request(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.url(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	name := c.bucket + "/" + key
+	var e s3Error
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(content, &e) == nil && e.Code != "" {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, name, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, name, resp.Status)
+}
+
+// s3Object is an object in bucket, or a local file
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+// s3Executor implements executor interface by synchronizing path with a prefix of a bucket
+// in either direction. Objects are compared by size and modification time, and by MD5 against
+// ETag if checksum is enabled
+type s3Executor struct {
+	client *s3Client
+	prefix string
+	path   string
+	// upload is true if path is the source, false if bucket is the source
+	upload bool
+	// delete removes extraneous objects or files after transfer
+	delete             bool
+	checksum           bool
+	concurrency        int
+	multipartThreshold int64
+	partSize           int64
+}
+
+func newS3Executor(cfg config.RepoConfig) (*s3Executor, error) {
+	options := map[string]string{}
+	for _, key := range []string{"endpoint", "region", "bucket", "prefix", "path", "direction", "delete",
+		"access_key_id", "secret_access_key_file"} {
+		value, err := stringOption(cfg, key)
+		if err != nil {
+			return nil, err
+		}
+		options[key] = value
+	}
+	if options["endpoint"] == "" || options["bucket"] == "" || options["path"] == "" {
+		return nil, errors.New("endpoint, bucket and path are required by s3 worker")
+	}
+	endpoint, err := url.Parse(options["endpoint"])
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, errors.New("endpoint should be an http or https URL")
+	}
+	if options["region"] == "" {
+		options["region"] = defaultS3Region
+	}
+	if options["access_key_id"] == "" {
+		options["access_key_id"] = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	prefix := strings.TrimPrefix(options["prefix"], "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s := &s3Executor{
+		client: &s3Client{
+			client:      newHTTPClient(),
+			endpoint:    endpoint,
+			bucket:      options["bucket"],
+			region:      options["region"],
+			accessKeyID: options["access_key_id"],
+			secretFile:  options["secret_access_key_file"],
+		},
+		prefix:             prefix,
+		path:               options["path"],
+		concurrency:        defaultConcurrency,
+		multipartThreshold: defaultMultipartThreshold << 20,
+		partSize:           defaultPartSize << 20,
+	}
+	switch options["direction"] {
+	case "upload":
+		s.upload = true
+	case "download":
+	default:
+		return nil, errors.New("direction should be upload or download")
+	}
+	switch options["delete"] {
+	case "", "none":
+	case "after":
+		s.delete = true
+	default:
+		return nil, errors.New("delete should be none or after when present")
+	}
+	if checksum, ok := cfg["checksum"]; ok {
+		if s.checksum, ok = checksum.(bool); !ok {
+			return nil, errors.New("checksum should be a boolean when present")
+		}
+	}
+	for key, target := range map[string]*int64{"multipart_threshold": &s.multipartThreshold, "part_size": &s.partSize} {
+		if value, ok := cfg[key]; ok {
+			mib, ok := value.(int)
+			if !ok || mib <= 0 {
+				return nil, fmt.Errorf("%s should be a positive integer when present", key)
+			}
+			*target = int64(mib) << 20
+		}
+	}
+	// S3 allows parts of at least 5 MiB except the last one
+	if s.partSize < 5<<20 {
+		return nil, errors.New("part_size should be at least 5")
+	}
+	if concurrency, ok := cfg["concurrency"]; ok {
+		if s.concurrency, ok = concurrency.(int); !ok || s.concurrency <= 0 {
+			return nil, errors.New("concurrency should be a positive integer when present")
+		}
+	}
+	return s, nil
+}
+
+// listRemote lists objects under prefix by relative path, following continuation tokens
+func (s *s3Executor) listRemote(ctx context.Context) (map[string]s3Object, error) {
+	objects := map[string]s3Object{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.client.request(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+			Contents              []s3Object `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			rel := strings.TrimPrefix(object.Key, s.prefix)
+			// skip directory markers, and keys which can't be local paths
+			if strings.HasSuffix(rel, "/") || !fs.ValidPath(rel) || rel == "." {
+				continue
+			}
+			object.ETag = strings.Trim(object.ETag, `"`)
+			objects[rel] = object
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// listLocal lists regular files in path by relative path
+func (s *s3Executor) listLocal(r *s3Run) (map[string]s3Object, error) {
+	files := map[string]s3Object{}
+	err := filepath.WalkDir(r.path, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == r.path {
+			return filepath.SkipDir
+		}
+		if err != nil || !d.Type().IsRegular() || strings.HasSuffix(p, partSuffix) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(r.path, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = s3Object{Key: s.prefix + filepath.ToSlash(rel), LastModified: info.ModTime(), Size: info.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// etagOf computes ETag of a local file as S3 does, for single part uploads or multipart
+// uploads with partSize
+func etagOf(file string, partSize int64, multipart bool) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if !multipart {
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	var sums []byte
+	parts := 0
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, partSize)
+		if n > 0 {
+			sums = append(sums, h.Sum(nil)...)
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
+
+// matchesETag compares a local file with ETag of an object. ETags of multipart uploads with
+// another part size, or of encrypted objects, can't be compared and are trusted
+func (s *s3Executor) matchesETag(file string, etag string) bool {
+	sum, parts, multipart := strings.Cut(etag, "-")
+	if len(sum) != 32 {
+		return true
+	}
+	local, err := etagOf(file, s.partSize, multipart)
+	if err != nil {
+		return false
+	}
+	if multipart && !strings.HasSuffix(local, "-"+parts) {
+		return true
+	}
+	return local == etag
+}
+
+// outdated returns whether dst should be replaced by src
+func (s *s3Executor) outdated(r *s3Run, rel string, src s3Object, dst s3Object, exists bool) bool {
+	if !exists || src.Size != dst.Size {
+		return true
+	}
+	local := filepath.Join(r.path, filepath.FromSlash(rel))
+	if s.upload {
+		// objects are newer than local files unless they are modified after upload, and
+		// Last-Modified of objects has a precision of seconds
+		if src.LastModified.Truncate(time.Second).After(dst.LastModified) {
+			return true
+		}
+		return s.checksum && !s.matchesETag(local, dst.ETag)
+	}
+	// modification time of downloaded files is set to Last-Modified
+	if src.LastModified.Unix() != dst.LastModified.Unix() {
+		return true
+	}
+	return s.checksum && !s.matchesETag(local, src.ETag)
+}
+
+// s3Run is the state of a sync of s3 worker
+type s3Run struct {
+	ctx context.Context
+	// path is the directory synced in this run, see targetPath
+	path     string
+	stdout   strings.Builder
+	stderr   strings.Builder
+	transfer exporter.TransferStats
+	mutex    sync.Mutex
+}
+
+// put uploads a file, in parts if it is larger than multipartThreshold
+func (s *s3Executor) put(r *s3Run, rel string, object s3Object) error {
+	file := filepath.Join(r.path, filepath.FromSlash(rel))
+	if object.Size > s.multipartThreshold {
+		return s.putMultipart(r.ctx, file, object.Key)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.request(r.ctx, http.MethodPut, object.Key, nil, contentMD5(content), content)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// contentMD5 returns Content-MD5 header of body, which is verified by S3
+func contentMD5(body []byte) http.Header {
+	sum := md5.Sum(body)
+	return http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+}
+
+// putMultipart uploads a file by multipart upload, which is aborted on failure
+func (s *s3Executor) putMultipart(ctx context.Context, file string, key string) error {
+	resp, err := s.client.request(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	err = s.uploadParts(ctx, file, key, initiated.UploadID)
+	if err != nil {
+		if resp, abortErr := s.client.request(ctx, http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+// s3Part is a part in request completing multipart upload
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *s3Executor) uploadParts(ctx context.Context, file string, key string, uploadID string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var parts []s3Part
+	buffer := make([]byte, s.partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(f, buffer)
+		if n == 0 && number > 1 {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}
+		resp, err := s.client.request(ctx, http.MethodPut, key, query, contentMD5(buffer[:n]), buffer[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		if n < len(buffer) {
+			break
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.request(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// completion could fail after 200 OK, reported in body
+	var e s3Error
+	content, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(content, &e) == nil && e.Code != "" {
+		return fmt.Errorf("complete %s: %s: %s", key, e.Code, e.Message)
+	}
+	return nil
+}
+
+// get downloads an object, verifying its size, and MD5 if its ETag is a plain MD5
+func (s *s3Executor) get(r *s3Run, rel string, object s3Object) (downloadResult, error) {
+	dest := filepath.Join(r.path, filepath.FromSlash(rel))
+	result, err := fetch(r.ctx, s.client, download{
+		url:  s.client.url(object.Key, nil).String(),
+		dest: dest,
+		size: object.Size,
+	})
+	if err != nil {
+		return result, err
+	}
+	if sum, _, multipart := strings.Cut(object.ETag, "-"); !multipart && len(sum) == 32 {
+		if local, err := etagOf(dest, s.partSize, false); err != nil || local != sum {
+			_ = os.Remove(dest)
+			return result, fmt.Errorf("GET %s: md5 mismatch: expected %s, got %s", object.Key, sum, local)
+		}
+	}
+	return result, nil
+}
+
+// deleteExtraneous removes objects or files which are not in src
+func (s *s3Executor) deleteExtraneous(r *s3Run, src map[string]s3Object, dst map[string]s3Object) error {
+	if !s.upload {
+		return removeExtraneous(r.path, func(rel string, dir bool) bool {
+			_, ok := src[rel]
+			return !dir && ok
+		}, func(rel string) {
+			fmt.Fprintf(&r.stdout, "deleted %s\n", rel)
+		})
+	}
+	var extraneous []string
+	for rel := range dst {
+		if _, ok := src[rel]; !ok {
+			extraneous = append(extraneous, rel)
+		}
+	}
+	sort.Strings(extraneous)
+	var failed int
+	forEachParallel(len(extraneous), s.concurrency, func(i int) {
+		resp, err := s.client.request(r.ctx, http.MethodDelete, dst[extraneous[i]].Key, nil, nil, nil)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if err != nil {
+			failed++
+			fmt.Fprintf(&r.stderr, "%s: %v\n", extraneous[i], err)
+			return
+		}
+		resp.Body.Close()
+		fmt.Fprintf(&r.stdout, "deleted %s\n", extraneous[i])
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deletions failed", failed, len(extraneous))
+	}
+	return nil
+}
+
+func (s *s3Executor) sync(r *s3Run, logger *logrus.Entry) error {
+	remote, err := s.listRemote(r.ctx)
+	if err != nil {
+		return err
+	}
+	local, err := s.listLocal(r)
+	if err != nil {
+		return err
+	}
+	src, dst := remote, local
+	if s.upload {
+		src, dst = local, remote
+	}
+	var outdated []string
+	for rel, object := range src {
+		r.transfer.TotalSize += object.Size
+		if existing, exists := dst[rel]; s.outdated(r, rel, object, existing, exists) {
+			outdated = append(outdated, rel)
+		}
+	}
+	sort.Strings(outdated)
+	logger.WithField("event", "s3_outdated").Debugf("%d of %d files are outdated", len(outdated), len(src))
+	var failed int
+	forEachParallel(len(outdated), s.concurrency, func(i int) {
+		rel := outdated[i]
+		var result downloadResult
+		var err error
+		if s.upload {
+			err = s.put(r, rel, src[rel])
+		} else {
+			result, err = s.get(r, rel, src[rel])
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.transfer.BytesReceived += result.bytes
+		if err != nil {
+			failed++
+			fmt.Fprintf(&r.stderr, "%s: %v\n", rel, err)
+			return
+		}
+		r.transfer.FilesTransferred++
+		if s.upload {
+			fmt.Fprintf(&r.stdout, "uploaded %s\n", rel)
+		} else {
+			fmt.Fprintf(&r.stdout, "downloaded %s\n", rel)
+		}
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(outdated))
+	}
+	// an empty source is more likely a misconfiguration than a mirror to be wiped out
+	if s.delete && len(src) > 0 {
+		return s.deleteExtraneous(r, src, dst)
+	}
+	return nil
+}
+
+func (s *s3Executor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
+	r := &s3Run{ctx: ctx, path: targetPath(ctx, s.path)}
+	err := s.sync(r, logger)
+	return execResult{
+		Stdout:   r.stdout.String(),
+		Stderr:   r.stderr.String(),
+		Transfer: &r.transfer,
+	}, err
+}
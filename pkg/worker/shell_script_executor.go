@@ -1,29 +1,40 @@
 package worker
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/sirupsen/logrus"
 	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
 	"mvdan.cc/sh/v3/shell"
 )
 
 // shellScriptExecutor implements executor interface
 type shellScriptExecutor struct {
 	cfg config.RepoConfig
+	// outputParser extracts transfer accounting from stdout, empty if disabled
+	outputParser string
 }
 
-func newShellScriptExecutor(cfg config.RepoConfig) *shellScriptExecutor {
-	return &shellScriptExecutor{
+func newShellScriptExecutor(cfg config.RepoConfig) (*shellScriptExecutor, error) {
+	w := &shellScriptExecutor{
 		cfg: cfg,
 	}
+	if outputParser, ok := cfg["output_parser"]; ok {
+		switch outputParser {
+		case "rsync":
+			w.outputParser = "rsync"
+		default:
+			return nil, errors.New("output_parser should be rsync when present")
+		}
+	}
+	return w, nil
 }
 
 func convertMapToEnvVars(m map[string]interface{}) (map[string]string, error) {
@@ -63,10 +74,10 @@ func getOsEnvsAsMap() (result map[string]string) {
 }
 
 // RunSync launches the worker
-func (w *shellScriptExecutor) RunOnce(logger *logrus.Entry, utilities []utility) (execResult, error) {
+func (w *shellScriptExecutor) RunOnce(ctx context.Context, logger *logrus.Entry, utilities []utility) (execResult, error) {
 	script, ok := w.cfg["script"]
 	if !ok {
-		return execResult{"", ""}, errors.New("script not found in config")
+		return execResult{}, errors.New("script not found in config")
 	}
 
 	// Split the command string into fields, respecting shell quoting rules
@@ -74,53 +85,74 @@ func (w *shellScriptExecutor) RunOnce(logger *logrus.Entry, utilities []utility)
 		return getOsEnvsAsMap()[name]
 	})
 	if err != nil {
-		return execResult{"", ""}, fmt.Errorf("failed to parse command: %w", err)
+		return execResult{}, fmt.Errorf("failed to parse command: %w", err)
 	}
 
 	if len(fields) == 0 {
-		return execResult{"", ""}, errors.New("empty command")
+		return execResult{}, errors.New("empty command")
 	}
 
-	logger.Debug("Invoking command:", fields[0], "with args:", fields[1:])
-	cmd := exec.Command(fields[0], fields[1:]...)
-
 	// Forwarding config items to shell script as environmental variables
 	// Adds a LUG_ prefix to their key
-	env := os.Environ()
+	var env []string
 	envvars, err := convertMapToEnvVars(w.cfg)
 	if err != nil {
-		return execResult{"", ""}, errors.New(fmt.Sprint("cannot convert w.cfg to env vars: ", err))
+		return execResult{}, errors.New(fmt.Sprint("cannot convert w.cfg to env vars: ", err))
+	}
+	// scripts sync into the snapshot being staged if any
+	if path, _ := w.cfg["path"].(string); targetPath(ctx, path) != "" {
+		envvars["LUG_path"] = targetPath(ctx, path)
 	}
 	for k, v := range envvars {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
-	cmd.Env = env
 
-	for _, utility := range utilities {
-		logger.WithField("event", "exec_prehook").Debug("Executing prehook of ", utility)
-		if err := utility.preHook(); err != nil {
-			logger.Error("Failed to execute preHook:", err)
-		}
+	// Scripts could report metrics by writing to the file at $LUG_METRICS_FILE, or to fd $LUG_METRICS_FD
+	metricsFile, err := os.CreateTemp("", "lug-metrics-*")
+	if err != nil {
+		return execResult{}, fmt.Errorf("cannot create metrics file: %w", err)
 	}
+	defer os.Remove(metricsFile.Name())
+	metricsFile.Close()
+	metricsFd, err := os.OpenFile(metricsFile.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return execResult{}, fmt.Errorf("cannot open metrics file: %w", err)
+	}
+	defer metricsFd.Close()
+	env = append(env, "LUG_METRICS_FILE="+metricsFile.Name(), "LUG_METRICS_FD=3")
 
-	var bufErr, bufOut bytes.Buffer
-	cmd.Stdout = &bufOut
-	cmd.Stderr = &bufErr
-
-	err = cmd.Start()
-
-	for _, utility := range utilities {
-		logger.WithField("event", "exec_posthook").Debug("Executing postHook of ", utility)
-		if err := utility.postHook(); err != nil {
-			logger.Error("Failed to execute postHook:", err)
-		}
+	cmd := command{
+		name:       fields[0],
+		args:       fields[1:],
+		env:        env,
+		extraFiles: []*os.File{metricsFd},
+	}
+	result, _, err := cmd.run(ctx, logger, utilities)
+	if errors.Is(err, errCannotStart) {
+		return result, err
 	}
+	result.Metrics = readScriptMetrics(logger, metricsFile.Name())
+	if w.outputParser == "rsync" {
+		result.Transfer = parseRsyncStats(result.Stdout)
+	}
+	if err != nil {
+		return result, errors.New("execution failed")
+	}
+	return result, nil
+}
+
+// readScriptMetrics reads metrics reported by script. Invalid metrics are logged and ignored
+func readScriptMetrics(logger *logrus.Entry, path string) []exporter.ScriptMetric {
+	file, err := os.Open(path)
 	if err != nil {
-		return execResult{"", ""}, errors.New("execution cannot start")
+		logger.WithField("event", "read_script_metrics_failed").Warn(err)
+		return nil
 	}
-	err = cmd.Wait()
+	defer file.Close()
+	metrics, err := exporter.ParseScriptMetrics(file)
 	if err != nil {
-		return execResult{bufOut.String(), bufErr.String()}, errors.New("execution failed")
+		logger.WithField("event", "invalid_script_metrics").Warn("Invalid metrics reported by script: ", err)
+		return nil
 	}
-	return execResult{bufOut.String(), bufErr.String()}, nil
+	return metrics
 }
@@ -0,0 +1,282 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+const (
+	// snapshotDir contains snapshots under path
+	snapshotDir = "snapshots"
+	// currentLink is a symlink under path to the published snapshot, which should be served
+	currentLink = "current"
+	// stagingSuffix is appended to snapshots being synced
+	stagingSuffix = ".lug-staging"
+	// defaultSnapshotKeep is used if "snapshot_keep" is not specified
+	defaultSnapshotKeep = 2
+)
+
+var (
+	// ErrSnapshotDisabled is returned by Rollback if the worker does not publish snapshots
+	ErrSnapshotDisabled = errors.New("snapshot is not enabled")
+	// ErrNoPreviousSnapshot is returned by Rollback if there is no snapshot to roll back to
+	ErrNoPreviousSnapshot = errors.New("no previous snapshot")
+	// ErrSyncing is returned by Rollback if the worker is syncing
+	ErrSyncing = errors.New("worker is syncing")
+)
+
+// targetKey is the context key of the directory executors sync into
+type targetKey struct{}
+
+// withTarget returns a context asking executors to sync into dir instead of their path
+func withTarget(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, targetKey{}, dir)
+}
+
+// targetPath returns the directory executors should sync into, which is the snapshot being
+// staged if any, or path
+func targetPath(ctx context.Context, path string) string {
+	if dir, ok := ctx.Value(targetKey{}).(string); ok {
+		return dir
+	}
+	return path
+}
+
+// snapshots publishes synced trees of a worker atomically. Each sync runs in a new directory
+// under path/snapshots seeded with hardlinks of the published one, and path/current is
+// swapped to it by rename when the sync succeeds. Files must be replaced rather than
+// modified in place, as all executors do, or older snapshots are modified as well
+type snapshots struct {
+	root string
+	// keep is how many snapshots before the published one are kept for rollback
+	keep int
+}
+
+// newSnapshots parses snapshot options, and returns nil if snapshot is disabled
+func newSnapshots(cfg config.RepoConfig) (*snapshots, error) {
+	enabled := false
+	if value, ok := cfg["snapshot"]; ok {
+		if enabled, ok = value.(bool); !ok {
+			return nil, errors.New("snapshot should be a boolean when present")
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+	root, ok := cfg["path"].(string)
+	if !ok || root == "" {
+		return nil, errors.New("path is required by snapshot")
+	}
+	s := &snapshots{root: root, keep: defaultSnapshotKeep}
+	if value, ok := cfg["snapshot_keep"]; ok {
+		if s.keep, ok = value.(int); !ok || s.keep < 0 {
+			return nil, errors.New("snapshot_keep should be a non-negative integer when present")
+		}
+	}
+	return s, nil
+}
+
+// list returns names of published snapshots from the oldest
+func (s *snapshots) list() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, snapshotDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasSuffix(entry.Name(), stagingSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// current returns name of the published snapshot, empty if nothing is published
+func (s *snapshots) current() (string, error) {
+	target, err := os.Readlink(filepath.Join(s.root, currentLink))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// stage creates a directory to sync into, seeded with hardlinks of the published snapshot,
+// or of the tree in path if nothing is published yet, so that enabling snapshot on an
+// existing mirror downloads nothing again. Staging directories left by interrupted syncs are
+// removed
+func (s *snapshots) stage() (string, error) {
+	dir := filepath.Join(s.root, snapshotDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+stagingSuffix))
+	if err != nil {
+		return "", err
+	}
+	for _, p := range stale {
+		if err := os.RemoveAll(p); err != nil {
+			return "", err
+		}
+	}
+	current, err := s.current()
+	if err != nil {
+		return "", err
+	}
+	staging := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z")+stagingSuffix)
+	if current == "" {
+		err = s.seedFromRoot(staging)
+	} else {
+		err = linkTree(filepath.Join(dir, current), staging)
+	}
+	if err != nil {
+		_ = os.RemoveAll(staging)
+		return "", fmt.Errorf("failed to seed snapshot: %w", err)
+	}
+	return staging, nil
+}
+
+// seedFromRoot copies the tree in path besides snapshots into staging, hardlinking files
+func (s *snapshots) seedFromRoot(staging string) error {
+	if err := os.Mkdir(staging, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case snapshotDir, currentLink, currentLink + partSuffix:
+			continue
+		}
+		if err := linkTree(filepath.Join(s.root, entry.Name()), filepath.Join(staging, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkTree copies the tree of src into dst, hardlinking files. Partial downloads are skipped
+// since they are appended in place
+func linkTree(src string, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return os.Mkdir(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular() && !strings.HasSuffix(p, partSuffix):
+			return os.Link(p, target)
+		}
+		return nil
+	})
+}
+
+// publish renames a staged directory to a snapshot, and points current to it. It returns
+// name of the snapshot. Old snapshots are left to prune
+func (s *snapshots) publish(staging string) (string, error) {
+	name := strings.TrimSuffix(filepath.Base(staging), stagingSuffix)
+	names, err := s.list()
+	if err != nil {
+		return "", err
+	}
+	// names only grow, even if syncs finish within a second or the clock goes back
+	if len(names) > 0 && name <= names[len(names)-1] {
+		name = names[len(names)-1] + "-1"
+	}
+	if err := os.Rename(staging, filepath.Join(s.root, snapshotDir, name)); err != nil {
+		return "", err
+	}
+	if err := s.swap(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// prune removes snapshots beyond keep before the published one
+func (s *snapshots) prune() error {
+	names, err := s.list()
+	if err != nil {
+		return err
+	}
+	current, err := s.current()
+	if err != nil {
+		return err
+	}
+	i := sort.SearchStrings(names, current)
+	if i == len(names) || names[i] != current {
+		return nil
+	}
+	for _, old := range names[:max(i-s.keep, 0)] {
+		if err := os.RemoveAll(filepath.Join(s.root, snapshotDir, old)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swap points current to snapshot name atomically
+func (s *snapshots) swap(name string) error {
+	link := filepath.Join(s.root, currentLink)
+	tmp := link + partSuffix
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(snapshotDir, name), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// rollback points current to the snapshot before it, and renames the abandoned one as a
+// staging directory so that it is never published again. It returns name of the published
+// snapshot and where the abandoned one is, which should be removed
+func (s *snapshots) rollback() (string, string, error) {
+	names, err := s.list()
+	if err != nil {
+		return "", "", err
+	}
+	current, err := s.current()
+	if err != nil {
+		return "", "", err
+	}
+	i := sort.SearchStrings(names, current)
+	if current == "" || i == 0 || i == len(names) || names[i] != current {
+		return "", "", ErrNoPreviousSnapshot
+	}
+	if err := s.swap(names[i-1]); err != nil {
+		return "", "", err
+	}
+	abandoned := filepath.Join(s.root, snapshotDir, current+".rollback"+stagingSuffix)
+	return names[i-1], abandoned, os.Rename(filepath.Join(s.root, snapshotDir, current), abandoned)
+}
@@ -0,0 +1,242 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"mvdan.cc/sh/v3/shell"
+
+	"github.com/sjtug/lug/pkg/config"
+)
+
+// FailVerification is FailReason of runs which succeeded but failed verification
+const FailVerification = "verification_failed"
+
+// maxReportedMismatches limits checksum mismatches written to stderr
+const maxReportedMismatches = 20
+
+// verifier checks the synced tree after a successful sync. Verification failures are not
+// retried, since syncing again is unlikely to help
+type verifier struct {
+	// command is run with LUG_path set to the tree, empty if not configured
+	command []string
+	// sha256sums is a checksum manifest in the tree, like SHA256SUMS. Paths in it are
+	// relative to its directory
+	sha256sums string
+	// sentinels are files required in the tree
+	sentinels []string
+	// minFilesRatio and minSizeRatio are how much the number of files and total size may
+	// shrink to since the previous verified run, 0 if unchecked
+	minFilesRatio float64
+	minSizeRatio  float64
+	// files and size of the previous accepted tree, 0 if unknown
+	files int64
+	size  int64
+	mutex sync.Mutex
+}
+
+// verifiedTree is the number of files and total size of a verified tree, zero if they are
+// not counted
+type verifiedTree struct {
+	files int64
+	size  int64
+}
+
+// ratioOption parses a ratio between 0 and 1, which could be written as an integer in YAML
+func ratioOption(cfg config.RepoConfig, key string) (float64, error) {
+	value, ok := cfg[key]
+	if !ok {
+		return 0, nil
+	}
+	var ratio float64
+	switch v := value.(type) {
+	case int:
+		ratio = float64(v)
+	case float64:
+		ratio = v
+	default:
+		ratio = -1
+	}
+	if ratio < 0 || ratio > 1 {
+		return 0, fmt.Errorf("%s should be a number between 0 and 1 when present", key)
+	}
+	return ratio, nil
+}
+
+// newVerifier parses verify options, and returns nil if nothing is to be verified
+func newVerifier(cfg config.RepoConfig) (*verifier, error) {
+	v := &verifier{}
+	command, err := stringOption(cfg, "verify_command")
+	if err != nil {
+		return nil, err
+	}
+	if v.command, err = shell.Fields(command, os.Getenv); err != nil {
+		return nil, fmt.Errorf("failed to parse verify_command: %w", err)
+	}
+	if v.sha256sums, err = stringOption(cfg, "verify_sha256sums"); err != nil {
+		return nil, err
+	}
+	if v.sha256sums != "" && (!fs.ValidPath(v.sha256sums) || v.sha256sums == ".") {
+		return nil, errors.New("verify_sha256sums should be a relative path when present")
+	}
+	sentinels, err := stringOption(cfg, "verify_sentinels")
+	if err != nil {
+		return nil, err
+	}
+	v.sentinels = strings.Fields(sentinels)
+	for _, sentinel := range v.sentinels {
+		if !fs.ValidPath(sentinel) {
+			return nil, fmt.Errorf("invalid sentinel %q", sentinel)
+		}
+	}
+	if v.minFilesRatio, err = ratioOption(cfg, "verify_min_files_ratio"); err != nil {
+		return nil, err
+	}
+	if v.minSizeRatio, err = ratioOption(cfg, "verify_min_size_ratio"); err != nil {
+		return nil, err
+	}
+	builtin := v.sha256sums != "" || len(v.sentinels) > 0 || v.minFilesRatio > 0 || v.minSizeRatio > 0
+	if !builtin && len(v.command) == 0 {
+		return nil, nil
+	}
+	if p, _ := cfg["path"].(string); builtin && p == "" {
+		return nil, errors.New("path is required by verify_sha256sums, verify_sentinels and verify ratios")
+	}
+	return v, nil
+}
+
+// State returns counts of the previous verified tree to be checkpointed
+func (v *verifier) State() map[string]string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.files == 0 && v.size == 0 {
+		return nil
+	}
+	return map[string]string{
+		"verified_files": strconv.FormatInt(v.files, 10),
+		"verified_size":  strconv.FormatInt(v.size, 10),
+	}
+}
+
+// Restore restores counts of the previous verified tree, ignoring invalid ones
+func (v *verifier) Restore(state map[string]string) {
+	files, filesErr := strconv.ParseInt(state["verified_files"], 10, 64)
+	size, sizeErr := strconv.ParseInt(state["verified_size"], 10, 64)
+	if filesErr != nil || sizeErr != nil {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.files, v.size = files, size
+}
+
+// verify checks the tree in dir. Outputs of verify_command and checksum mismatches are
+// returned in result. The tree is compared with the previous accepted one, but becomes the
+// baseline of later runs only after accept, since it may never be published
+func (v *verifier) verify(ctx context.Context, logger *logrus.Entry, utilities []utility, dir string) (execResult, verifiedTree, error) {
+	var result execResult
+	var tree verifiedTree
+	if len(v.command) > 0 {
+		cmd := command{name: v.command[0], args: v.command[1:], env: []string{"LUG_path=" + dir}}
+		var err error
+		if result, _, err = cmd.run(ctx, logger, utilities); err != nil {
+			return result, tree, fmt.Errorf("verify_command failed: %w", err)
+		}
+	}
+	if dir == "" {
+		return result, tree, nil
+	}
+	for _, sentinel := range v.sentinels {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(sentinel))); err != nil {
+			return result, tree, fmt.Errorf("sentinel %s is missing", sentinel)
+		}
+	}
+	if v.sha256sums != "" {
+		var stderr strings.Builder
+		err := v.checkSums(dir, &stderr)
+		result.Stderr += stderr.String()
+		if err != nil {
+			return result, tree, err
+		}
+	}
+	if v.minFilesRatio == 0 && v.minSizeRatio == 0 {
+		return result, tree, nil
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tree.files++
+		tree.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return result, tree, err
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if float64(tree.files) < v.minFilesRatio*float64(v.files) {
+		return result, tree, fmt.Errorf("number of files shrank from %d to %d", v.files, tree.files)
+	}
+	if float64(tree.size) < v.minSizeRatio*float64(v.size) {
+		return result, tree, fmt.Errorf("total size shrank from %d to %d", v.size, tree.size)
+	}
+	return result, tree, nil
+}
+
+// accept records a verified tree as the baseline of later runs, once it is published
+func (v *verifier) accept(tree verifiedTree) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.files, v.size = tree.files, tree.size
+}
+
+// checkSums verifies files listed in the checksum manifest, in the format of sha256sum
+func (v *verifier) checkSums(dir string, stderr *strings.Builder) error {
+	manifest := filepath.Join(dir, filepath.FromSlash(v.sha256sums))
+	content, err := os.ReadFile(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", v.sha256sums, err)
+	}
+	base := path.Dir(v.sha256sums)
+	var checked, failed int
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, name, found := strings.Cut(line, " ")
+		// binary mode is marked by *
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		rel := path.Join(base, name)
+		if !found || len(sum) != 64 || !fs.ValidPath(rel) {
+			return fmt.Errorf("%s: invalid line %q", v.sha256sums, line)
+		}
+		checked++
+		if err := verify(filepath.Join(dir, filepath.FromSlash(rel)), -1, sum); err != nil {
+			failed++
+			if failed <= maxReportedMismatches {
+				fmt.Fprintf(stderr, "%s: %v\n", rel, err)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files in %s failed checksum", failed, checked, v.sha256sums)
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"time"
 
 	"github.com/sjtug/lug/pkg/config"
+	"github.com/sjtug/lug/pkg/exporter"
 )
 
 // Worker declares interface for workers using diffenent ways of sync.
@@ -15,37 +17,109 @@ type Worker interface {
 	RunSync()
 	// This call should be thread-safe
 	TriggerSync()
+	// TriggerSyncWithContext triggers a sync traced as a child of the span in ctx.
+	// The span is ended when the sync finishes. This call should be thread-safe
+	TriggerSyncWithContext(ctx context.Context)
 
 	GetConfig() config.RepoConfig
 }
 
+// Checkpointer is implemented by workers with state saved in checkpoint of manager
+type Checkpointer interface {
+	// CheckpointState returns state to be checkpointed, nil if there is nothing to save.
+	// This call should be thread-safe
+	CheckpointState() map[string]string
+	// RestoreState restores state loaded from checkpoint before RunSync
+	RestoreState(state map[string]string)
+}
+
+// Rollbacker is implemented by workers publishing snapshots
+type Rollbacker interface {
+	// Rollback publishes the snapshot before the current one and removes the current one,
+	// returning name of the published snapshot. This call should be thread-safe
+	Rollback() (string, error)
+}
+
 // Status shows sync result and last timestamp.
 type Status struct {
 	// Result is true if sync succeed, else false
 	Result bool
 	// LastFinished indicates last success time
 	LastFinished time.Time
+	// LastEnded indicates when last sync ended, regardless of its result
+	LastEnded time.Time
 	// Idle stands for whether worker is idle, false if syncing
 	Idle bool
+	// DiskUsage is the size of "path" in bytes, 0 if unknown
+	DiskUsage int64
 	// Last stdout(s) for admin. Internal implementation may vary to provide it in Status()
 	Stdout []string
 	// Last stderr(s) for admin. Internal implementation may vary to provide it in Status()
 	Stderr []string
+	// Metrics reported by the script in last run
+	Metrics []exporter.ScriptMetric
+	// Transfer accounting of last run, nil if unknown
+	Transfer *exporter.TransferStats
+	// Git is HEAD and updated refs after last sync of a git worker
+	Git *GitStats `json:",omitempty"`
+	// FailReason is why the last run failed after syncing, e.g. verification_failed. Empty if
+	// it succeeded or the sync itself failed
+	FailReason string `json:"fail_reason,omitempty"`
+	// Snapshot is name of the published snapshot, empty if snapshot is disabled or nothing is published
+	Snapshot string `json:"snapshot,omitempty"`
+	// UpstreamUpdated is when upstream data was updated according to the freshness probe, nil if unknown
+	UpstreamUpdated *time.Time `json:"upstream_updated,omitempty"`
+	// UpstreamError is why the freshness probe failed, empty if it succeeded
+	UpstreamError string `json:"upstream_error,omitempty"`
+}
+
+// probeStatus fills result of freshness probe into status. p could be nil if it is not configured
+func (s *Status) probeStatus(p *freshnessProbe) {
+	if p == nil {
+		return
+	}
+	updated, err := p.Get()
+	if err != nil {
+		s.UpstreamError = err.Error()
+	} else if !updated.IsZero() {
+		s.UpstreamUpdated = &updated
+	}
 }
 
 // NewWorker generates a worker by config and log.
 func NewWorker(cfg config.RepoConfig, lastFinished time.Time, Result bool) (Worker, error) {
 	if syncType, ok := cfg["type"]; ok {
 		switch syncType {
-		case "rsync":
-			return nil, errors.New("rsync worker has been removed since 0.10. " +
-				"Use rsync.sh with shell_script worker at https://github.com/sjtug/mirror-docker instead")
-		case "shell_script":
+		case "rsync", "shell_script", "git", "http", "apt", "pypi", "oci", "s3":
+			var e executor
+			var err error
+			switch syncType {
+			case "rsync":
+				e, err = newRsyncExecutor(cfg)
+			case "git":
+				e, err = newGitExecutor(cfg)
+			case "http":
+				e, err = newHTTPExecutor(cfg)
+			case "apt":
+				e, err = newAptExecutor(cfg)
+			case "pypi":
+				e, err = newPyPIExecutor(cfg)
+			case "oci":
+				e, err = newOCIExecutor(cfg)
+			case "s3":
+				e, err = newS3Executor(cfg)
+			default:
+				e, err = newShellScriptExecutor(cfg)
+			}
+			if err != nil {
+				return nil, err
+			}
 			w, err := NewExecutorInvokeWorker(
-				newShellScriptExecutor(cfg),
+				e,
 				Status{
 					Result:       Result,
 					LastFinished: lastFinished,
+					LastEnded:    lastFinished,
 					Idle:         true,
 					Stdout:       make([]string, 0),
 					Stderr:       make([]string, 0),